@@ -40,7 +40,12 @@ async function main() {
         const adminUser = await provider.getUserContext(adminIdentity, 'admin');
                        
         // Register the user, enroll the user, and import the new identity into the wallet.
-        const secret = await ca.register({ affiliation: 'org1.department1', enrollmentID: 'user1', role: 'client' }, adminUser);
+        // The chaincode only accepts entryLogs from readers, for the facility in their certificate.
+        const attrs = [
+            { name: 'role', value: 'reader', ecert: true },
+            { name: 'facilityID', value: process.env.READER_FACILITY_ID || 'Facility1', ecert: true }
+        ];
+        const secret = await ca.register({ affiliation: 'org1.department1', enrollmentID: 'user1', role: 'client', attrs: attrs }, adminUser);
         const enrollment = await ca.enroll({ enrollmentID: 'user1', enrollmentSecret: secret });
         const x509Identity = {
             credentials: {
@@ -42,17 +42,12 @@ router.get('/entry', async (req, res) => {
     const tzOffset = new Date().getTimezoneOffset() * 60000;
     const tzDate = new Date(Date.now() - tzOffset);
   
-    const entryLogIndexFile = path.resolve(__dirname, '..', 'modules', 'entryLogIndex.json');
-    const entryLogIndex = JSON.parse(fs.readFileSync(entryLogIndexFile, 'utf-8'));
-  
     const peopleData = require('../modules/people');
     const personIndex = getRandomInt(0, 5);
-    const facilityIndex = getRandomInt(0, 5);
     const person = peopleData[personIndex];
   
     const transientData = {
-      entryLogID: `EntryLog${entryLogIndex.next}`,
-      facilityID: `Facility${facilityIndex}`,  
+      facilityID: process.env.READER_FACILITY_ID || 'Facility1',  // the facility of user1's certificate
       entryTime: tzDate.toISOString().replace(/T/, ' ').replace(/\..+/, ''),
       personalID: `Person${personIndex}`,
       ...person
@@ -62,14 +57,17 @@ router.get('/entry', async (req, res) => {
   
     const entryLog = Buffer.from(JSON.stringify(transientData)).toString('base64');
   
-    // Submit the specified transaction.
-    await contract.createTransaction('setEntryLog')
-        .setTransient({ entryLog: entryLog })
-        .submit();
-    console.log('Transaction has been submitted');
-  
-    entryLogIndex.next += 1;
-    fs.writeFileSync(entryLogIndexFile, JSON.stringify(entryLogIndex, null, 2));
+    // Submit the specified transaction. The chaincode assigns the entryLogID.
+    // The chaincode stores the personalID as a pseudonym keyed by the health authority's key, which only
+    // the peers of Org1 and Org3 hold, so the reader has Org1 endorse and never holds the key itself.
+    // Name, phone and address are encrypted with the AES key ENCRYPTION_KEY (hex) named ENCRYPTION_KEY_ID.
+    const encryptionKey = Buffer.from(process.env.ENCRYPTION_KEY, 'hex');
+    const encryptionKeyID = Buffer.from(process.env.ENCRYPTION_KEY_ID);
+    const result = JSON.parse(await contract.createTransaction('setEntryLog')
+        .setEndorsingOrganizations('Org1MSP')
+        .setTransient({ entryLog: entryLog, encryptionKey: encryptionKey, encryptionKeyID: encryptionKeyID })
+        .submit());
+    console.log(`Transaction has been submitted, entryLogID: ${result.entryLogID}`);
   
     await gateway.disconnect();
 
@@ -107,11 +105,15 @@ router.get('/entryLog/:personalID', async (req, res) => {
     // Get the contract from the network.
     const contract = network.getContract('entryLog');
 
+    // The ledger only holds pseudonyms, the Org1 peer resolves the raw personalID with its copy of the key.
+    // Only the person may list their entryLogs: user1 needs role=person and personalID in its certificate.
+    // They see the public entryLogs, the private details are for the health authority.
     const data = JSON.parse(await contract.evaluateTransaction('queryEntryLogsByPersonalID', personalID));
-    const privateData = JSON.parse(await contract.evaluateTransaction('getPrivateEntryLogByPerson', personalID));
-    let result = [];
-    for(let i = 0; i < data.length; i++) {
-      result.push(Object.assign(data[i].Record, privateData[i].Record));
+    // past its limit the query returns {records, bookmark, truncated} instead of an array
+    const records = Array.isArray(data) ? data : data.records;
+    const result = records.map(record => record.Record);
+    if (data.truncated) {
+      res.set('X-Truncated', 'true');
     }
     res.status(200).send(result);
     console.log(result);
@@ -38,7 +38,13 @@ async function main() {
         const contract = network.getContract('entryLog');
 
         // Evaluate the specified transaction.
-        const result = await contract.evaluateTransaction('getPrivateEntryLogByPerson', 'Person1');
+        const result = await contract.createTransaction('getPrivateEntryLogByPerson')
+            .setTransient({
+                pseudonymKey: Buffer.from(process.env.PSEUDONYM_KEY, 'hex'),
+                encryptionKey: Buffer.from(process.env.ENCRYPTION_KEY, 'hex'),
+                encryptionKeyID: Buffer.from(process.env.ENCRYPTION_KEY_ID)
+            })
+            .evaluate('Person1');
         console.log(`Transaction has been evaluated, result is: ${result.toString()}`);
 
         process.exit(0);
@@ -38,11 +38,13 @@ async function main() {
         const contract = network.getContract('entryLog');
 
         // Evaluate the specified transaction.
+        // The selector must match a facilityID, personalID or entryLogID and a limit is required.
         const query = {
             selector: {
                 docType: "entryLog",
                 facilityID: "Facility1"
-            }
+            },
+            limit: 50
         }
         const queryString = JSON.stringify(query);
 
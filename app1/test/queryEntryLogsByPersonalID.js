@@ -38,7 +38,9 @@ async function main() {
         const contract = network.getContract('entryLog');
 
         // Evaluate the specified transaction.
-        const result = await contract.evaluateTransaction('queryEntryLogsByPersonalID', 'Person1');
+        const result = await contract.createTransaction('queryEntryLogsByPersonalID')
+            .setTransient({ pseudonymKey: Buffer.from(process.env.PSEUDONYM_KEY, 'hex') })
+            .evaluate('Person1');
         console.log(`Transaction has been evaluated, result is: ${result.toString()}`);
 
         process.exit(0);
@@ -40,14 +40,10 @@ async function main() {
         const tzOffset = new Date().getTimezoneOffset() * 60000;
         const tzDate = new Date(Date.now() - tzOffset);
 
-        const entryLogIndexFile = path.resolve(__dirname, 'entryLogIndex.json');
-        const entryLogIndex = JSON.parse(fs.readFileSync(entryLogIndexFile, 'utf-8'));
-
         const transientData = {
-            entryLogID: `EntryLog${entryLogIndex.next}`,
             facilityID: `Facility1`,  // NFC로 등록해놓고 입력받기
             year: '1995',
-            sex: '1',
+            gender: '1',
             entryTime: tzDate.toISOString().replace(/T/, ' ').replace(/\..+/, ''),
             personalID: `Person1`,
             name: '박찬형',
@@ -57,14 +53,17 @@ async function main() {
 
         const entryLog = Buffer.from(JSON.stringify(transientData)).toString('base64');
 
-        // Submit the specified transaction.
-        await contract.createTransaction('setEntryLog')
-            .setTransient({ entryLog: entryLog })
-            .submit();
-        console.log('Transaction has been submitted');
-
-        entryLogIndex.next += 1;
-        fs.writeFileSync(entryLogIndexFile, JSON.stringify(entryLogIndex, null, 2));
+        // Submit the specified transaction. The chaincode assigns the entryLogID.
+        // The chaincode stores the personalID as a pseudonym keyed by the health authority's key, which only
+        // the peers of Org1 and Org3 hold, so the reader has Org1 endorse and never holds the key itself.
+        // Name, phone and address are encrypted with the AES key ENCRYPTION_KEY (hex) named ENCRYPTION_KEY_ID.
+        const encryptionKey = Buffer.from(process.env.ENCRYPTION_KEY, 'hex');
+        const encryptionKeyID = Buffer.from(process.env.ENCRYPTION_KEY_ID);
+        const result = JSON.parse(await contract.createTransaction('setEntryLog')
+            .setEndorsingOrganizations('Org1MSP')
+            .setTransient({ entryLog: entryLog, encryptionKey: encryptionKey, encryptionKeyID: encryptionKeyID })
+            .submit());
+        console.log(`Transaction has been submitted, entryLogID: ${result.entryLogID}`);
 
         // Disconnect from the gateway.
         await gateway.disconnect();
@@ -34,7 +34,9 @@ router.get('/entryLog/:facilityID', async function(req, res, next) {
     // Get the contract from the network.
     const contract = network.getContract('entryLog');
 
-    const data = JSON.parse(await contract.evaluateTransaction('queryEntryLogsByFacilityID', facilityID));
+    // ?pageSize=n&bookmark=b returns one page with the bookmark of the next
+    const pageArgs = req.query.pageSize ? [req.query.pageSize, req.query.bookmark || ''] : [];
+    const data = JSON.parse(await contract.evaluateTransaction('queryEntryLogsByFacilityID', facilityID, ...pageArgs));
     res.status(200).send(data);
     console.log(data);
 
@@ -38,8 +38,13 @@ async function main() {
         const contract = network.getContract('entryLog');
 
         // Evaluate the specified transaction.
-        const result = await contract.evaluateTransaction('queryEntryLogsByFacilityID', 'Facility1');
-        console.log(`Transaction has been evaluated, result is: ${result.toString()}`);
+        // Read the facility's entryLogs a page at a time until the bookmark comes back empty.
+        let bookmark = '';
+        do {
+            const result = await contract.evaluateTransaction('queryEntryLogsByFacilityID', 'Facility1', '50', bookmark);
+            console.log(`Transaction has been evaluated, result is: ${result.toString()}`);
+            bookmark = JSON.parse(result.toString()).bookmark;
+        } while (bookmark);
 
         process.exit(0);
     } catch (error) {
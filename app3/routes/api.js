@@ -5,6 +5,18 @@ const { Wallets, Gateway } = require('fabric-network');
 const path = require('path');
 const fs = require('fs');
 
+// Unpaged queries return an array of {Key, Record}, or past their limit
+// {records, bookmark, truncated}. The public and private records of an entryLog
+// share its Key, which is what they are joined on.
+function recordsOf(response) {
+  return Array.isArray(response) ? response : response.records;
+}
+
+function joinRecords(data, privateData) {
+  const privateByKey = new Map(recordsOf(privateData).map(record => [record.Key, record.Record]));
+  return recordsOf(data).map(record => Object.assign(record.Record, privateByKey.get(record.Key)));
+}
+
 /* GET users listing. */
 router.get('/entryLogs/facility/:facilityID', async function(req, res, next) {
   try {
@@ -35,11 +47,13 @@ router.get('/entryLogs/facility/:facilityID', async function(req, res, next) {
     const contract = network.getContract('entryLog');
 
     const data = JSON.parse(await contract.evaluateTransaction('queryEntryLogsByFacilityID', facilityID));
-    const privateData = JSON.parse(await contract.evaluateTransaction('getPrivateEntryLogByFacility', facilityID));
-    let result = [];
-    for(let i = 0; i < data.length; i++) {
-      console.log(privateData[i]);
-      // result.push(Object.assign(data[i].Record, privateData[i].Record));
+    // Name, phone and address are decrypted with ENCRYPTION_KEY.
+    const privateData = JSON.parse(await contract.createTransaction('getPrivateEntryLogByFacility')
+        .setTransient({ encryptionKey: Buffer.from(process.env.ENCRYPTION_KEY, 'hex'), encryptionKeyID: Buffer.from(process.env.ENCRYPTION_KEY_ID) })
+        .evaluate(facilityID));
+    const result = joinRecords(data, privateData);
+    if (data.truncated || privateData.truncated) {
+      res.set('X-Truncated', 'true');
     }
     res.status(200).send(result);
     console.log(result);
@@ -78,11 +92,20 @@ router.get('/entryLogs/personal/:personalID', async function(req, res, next) {
     // Get the contract from the network.
     const contract = network.getContract('entryLog');
 
-    const data = JSON.parse(await contract.evaluateTransaction('queryEntryLogsByPersonalID', personalID));
-    const privateData = JSON.parse(await contract.evaluateTransaction('getPrivateEntryLogByPerson', personalID));
-    let result = [];
-    for(let i = 0; i < data.length; i++) {
-      result.push(Object.assign(data[i].Record, privateData[i].Record));
+    // The ledger only holds pseudonyms, the raw personalID is resolved with the health authority's key.
+    // Name, phone and address are decrypted with ENCRYPTION_KEY.
+    const pseudonymKey = Buffer.from(process.env.PSEUDONYM_KEY, 'hex');
+    const encryptionKey = Buffer.from(process.env.ENCRYPTION_KEY, 'hex');
+    const encryptionKeyID = Buffer.from(process.env.ENCRYPTION_KEY_ID);
+    const data = JSON.parse(await contract.createTransaction('queryEntryLogsByPersonalID')
+        .setTransient({ pseudonymKey: pseudonymKey })
+        .evaluate(personalID));
+    const privateData = JSON.parse(await contract.createTransaction('getPrivateEntryLogByPerson')
+        .setTransient({ pseudonymKey: pseudonymKey, encryptionKey: encryptionKey, encryptionKeyID: encryptionKeyID })
+        .evaluate(personalID));
+    const result = joinRecords(data, privateData);
+    if (data.truncated || privateData.truncated) {
+      res.set('X-Truncated', 'true');
     }
     res.status(200).send(result);
     console.log(result);
@@ -0,0 +1,226 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// roleAttribute is the certificate attribute, registered with ecert=true at the CA,
+// that carries the role of a client identity
+const roleAttribute = "role"
+
+const (
+	roleReader           = "reader"           // NFC readers at facility entrances
+	roleFacilityOperator = "facilityOperator" // staff of the facilities, manage facilities and tags
+	roleHealthAuthority  = "healthAuthority"  // epidemiological investigators
+	roleAdmin            = "admin"            // operators of the network, run migrations
+	rolePerson           = "person"           // app users reading their own entryLogs and exposure alerts, see assertPersonCaller
+)
+
+// mspRoles - the roles every identity of an org has
+var mspRoles = map[string][]string{
+	"Org2MSP": {roleFacilityOperator},
+	"Org3MSP": {roleHealthAuthority},
+}
+
+// attributeRoles - the roles an org's CA may grant with the role attribute.
+// A role attribute another org's CA is not trusted with is ignored.
+var attributeRoles = map[string][]string{
+	"Org1MSP": {roleReader, rolePerson, roleAdmin},
+	"Org2MSP": {roleAdmin},
+	"Org3MSP": {roleAdmin},
+}
+
+var allRoles = []string{roleReader, roleFacilityOperator, roleHealthAuthority, roleAdmin}
+
+// functionRoles - the roles that may call each Invoke function. A function missing
+// here cannot be called at all.
+var functionRoles = map[string][]string{
+	"setEntryLog":                  {roleReader},
+	"setEntryLogs":                 {roleReader},
+	"getEntryLog":                  allRoles,
+	"getEntryLogPrivateDetails":    {roleHealthAuthority, roleAdmin},
+	"getPersonProfile":             {roleHealthAuthority, roleAdmin},
+	"updateAddress":                {roleHealthAuthority, roleAdmin},
+	"recordExit":                   {roleReader},
+	"delete":                       {roleAdmin},
+	"queryEntryLogsByFacilityID":   {roleFacilityOperator, roleHealthAuthority, roleAdmin},
+	"queryEntryLogsByPersonalID":   {rolePerson, roleHealthAuthority, roleAdmin},
+	"queryEntryLogs":               {roleHealthAuthority, roleAdmin},
+	"getPrivateEntryLogByFacility": {roleHealthAuthority, roleAdmin},
+	"getPrivateEntryLogByPerson":   {roleHealthAuthority, roleAdmin},
+	"queryEntryLogsByFacilityTime": {roleFacilityOperator, roleHealthAuthority, roleAdmin},
+	"queryEntryLogsByPersonTime":   {rolePerson, roleHealthAuthority, roleAdmin},
+	"traceContacts":                {roleHealthAuthority, roleAdmin},
+	"traceContactGraph":            {roleHealthAuthority, roleAdmin},
+	"createExposureAlert":          {roleHealthAuthority},
+	"getExposureAlerts":            {rolePerson, roleHealthAuthority},
+	"acknowledgeExposureAlert":     {rolePerson},
+	"resolveExposureAlert":         {roleHealthAuthority},
+	"getVisitStatistics":           {roleFacilityOperator, roleHealthAuthority, roleAdmin},
+	"getVisitStatisticsResult":     {roleFacilityOperator, roleHealthAuthority, roleAdmin},
+	"getPrivacyBudget":             {roleFacilityOperator, roleHealthAuthority, roleAdmin},
+	"setPrivacyBudget":             {roleAdmin},
+	"setNoiseSeed":                 {roleAdmin},
+	"getOccupancy":                 allRoles,
+	"setOccupancy":                 {roleFacilityOperator},
+	"migrateEntryLogs":             {roleAdmin},
+	"registerPseudonymKey":         {roleAdmin},
+	"registerFacility":             {roleFacilityOperator},
+	"updateFacility":               {roleFacilityOperator},
+	"getFacility":                  allRoles,
+	"listFacilities":               allRoles,
+	"registerTag":                  {roleFacilityOperator},
+	"revokeTag":                    {roleFacilityOperator},
+	"listTags":                     allRoles,
+}
+
+// facilityIDAttribute is the certificate attribute that binds a reader identity to
+// the facility whose entrances it reads
+const facilityIDAttribute = "facilityID"
+
+// personalIDAttribute is the certificate attribute that binds a person identity to the
+// personalID, raw or pseudonymized, whose exposure alerts it may read
+const personalIDAttribute = "personalID"
+
+// readerIdentity is the submitter of an entryLog, as certified by its org's CA
+type readerIdentity struct {
+	id         string // cid ID, the certificate subject and issuer
+	facilityID string
+}
+
+// ===========================================================================
+// authorize - fail unless the submitter has one of the roles that may call function
+// ===========================================================================
+func authorize(stub shim.ChaincodeStubInterface, function string) error {
+	allowed, ok := functionRoles[function]
+	if !ok {
+		return newError(errCodeUnknownFunction, "", "Received unknown function invocation: %s", function)
+	}
+
+	roles, err := callerRoles(stub)
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		if containsString(allowed, role) {
+			return nil
+		}
+	}
+	return newError(errCodePermissionDenied, "", "%s may only be called by %s", function, strings.Join(allowed, ", "))
+}
+
+// ===========================================================================
+// callerRoles - the roles of the submitter, from its MSP ID and role attribute
+// ===========================================================================
+func callerRoles(stub shim.ChaincodeStubInterface) ([]string, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, newError(errCodePermissionDenied, "", "Failed to get the MSP ID of the caller: %s", err.Error())
+	}
+	roles := append([]string{}, mspRoles[mspID]...)
+
+	role, found, err := cid.GetAttributeValue(stub, roleAttribute)
+	if err != nil {
+		return nil, newError(errCodePermissionDenied, "", "Failed to get the %s attribute of the caller: %s", roleAttribute, err.Error())
+	}
+	if found && containsString(attributeRoles[mspID], role) {
+		roles = append(roles, role)
+	}
+	return roles, nil
+}
+
+// ===========================================================================
+// getReader - the reader submitting entryLogs, whose certificate must have role=reader
+// and the facilityID attribute
+// ===========================================================================
+func getReader(stub shim.ChaincodeStubInterface) (*readerIdentity, error) {
+	err := cid.AssertAttributeValue(stub, roleAttribute, roleReader)
+	if err != nil {
+		return nil, newError(errCodePermissionDenied, "", "Caller must have the %s=%s attribute: %s", roleAttribute, roleReader, err.Error())
+	}
+	facilityID, found, err := cid.GetAttributeValue(stub, facilityIDAttribute)
+	if err != nil {
+		return nil, newError(errCodePermissionDenied, "", "Failed to get the %s attribute of the caller: %s", facilityIDAttribute, err.Error())
+	} else if !found || len(facilityID) == 0 {
+		return nil, newError(errCodePermissionDenied, "", "Caller must have the %s attribute", facilityIDAttribute)
+	}
+	id, err := cid.GetID(stub)
+	if err != nil {
+		return nil, newError(errCodePermissionDenied, "", "Failed to get the ID of the caller: %s", err.Error())
+	}
+	return &readerIdentity{id: id, facilityID: facilityID}, nil
+}
+
+// ===========================================================================
+// assertReaderFacility - entryLogs may only be submitted for the reader's own facility
+// ===========================================================================
+func assertReaderFacility(reader *readerIdentity, facilityID string) error {
+	if facilityID != reader.facilityID {
+		return newError(errCodePermissionDenied, "facilityID", "Caller reads facility %s, not %s", reader.facilityID, facilityID)
+	}
+	return nil
+}
+
+// ===========================================================================
+// assertPersonCaller - a person may only act for the personalID of their certificate's
+// personalID attribute. key pseudonymizes a raw attribute value.
+// ===========================================================================
+func assertPersonCaller(stub shim.ChaincodeStubInterface, key []byte, personalID string) error {
+	value, found, err := cid.GetAttributeValue(stub, personalIDAttribute)
+	if err != nil {
+		return newError(errCodePermissionDenied, "", "Failed to get the %s attribute of the caller: %s", personalIDAttribute, err.Error())
+	} else if !found || len(value) == 0 {
+		return newError(errCodePermissionDenied, "", "Caller must have the %s attribute", personalIDAttribute)
+	}
+	callerID, err := resolvePersonalID(key, personalIDAttribute, value)
+	if err != nil {
+		return err
+	}
+	if callerID != personalID {
+		return newError(errCodePermissionDenied, "personalID", "Caller may only act for their own personalID")
+	}
+	return nil
+}
+
+// ===========================================================================
+// assertFacilityQueryCaller - facility operators may only query the entryLogs of the
+// facilities their org owns, health authorities and admins those of any facility
+// ===========================================================================
+func assertFacilityQueryCaller(stub shim.ChaincodeStubInterface, facilityID string) error {
+	roles, err := callerRoles(stub)
+	if err != nil {
+		return err
+	}
+	if containsString(roles, roleHealthAuthority) || containsString(roles, roleAdmin) {
+		return nil
+	}
+	return assertFacilityOwner(stub, facilityID)
+}
+
+// ===========================================================================
+// assertPersonQueryCaller - persons may only query their own entryLogs, health
+// authorities and admins those of anyone. key pseudonymizes a raw personalID.
+// ===========================================================================
+func assertPersonQueryCaller(stub shim.ChaincodeStubInterface, key []byte, personalID string) error {
+	roles, err := callerRoles(stub)
+	if err != nil {
+		return err
+	}
+	if containsString(roles, roleHealthAuthority) || containsString(roles, roleAdmin) {
+		return nil
+	}
+	resolvedID, err := resolvePersonalID(key, "personalID", personalID)
+	if err != nil {
+		return err
+	}
+	return assertPersonCaller(stub, key, resolvedID)
+}
@@ -0,0 +1,375 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Exposure alerts tell a person to act on a contact found by tracing. They are kept in
+// collectionExposureAlerts, which the health authority and the persons' app org hold,
+// under the composite key exposureAlert~<alertID> and listed per person by the index
+// person~alert~<personalID>~<alertID>. An alert goes from active to acknowledged, when
+// the person saw it, to resolved, when the health authority closes it.
+const (
+	alertObjectType         = "exposureAlert"
+	alertIndexName          = "person~alert"
+	alertTransientKey       = "exposureAlert"
+	alertStatusActive       = "active"
+	alertStatusAcknowledged = "acknowledged"
+	alertStatusResolved     = "resolved"
+)
+
+const maxActionLength = 200
+
+type exposureAlert struct {
+	ObjectType            string `json:"docType"`
+	AlertID               string `json:"alertID"`
+	PersonalID            string `json:"personalID"`
+	FacilityID            string `json:"facilityID"`
+	Start                 string `json:"start"` // the exposure window, entryTime format
+	End                   string `json:"end"`
+	StartTimestamp        int64  `json:"startTimestamp"`
+	EndTimestamp          int64  `json:"endTimestamp"`
+	Action                string `json:"action"`    // what the person must do: get tested, self-isolate until ...
+	Status                string `json:"status"`    // active, acknowledged or resolved
+	CreatedBy             string `json:"createdBy"` // cid ID of the investigator
+	CreatedTimestamp      int64  `json:"createdTimestamp"`
+	AcknowledgedTimestamp int64  `json:"acknowledgedTimestamp,omitempty"`
+	ResolvedTimestamp     int64  `json:"resolvedTimestamp,omitempty"`
+}
+
+// ===========================================================================
+// createExposureAlert - record an exposure alert for a person.
+// Transient: exposureAlert {alertID (optional, the transaction ID by default), personalID,
+// facilityID, start, end, action}; pseudonymKey, needed for a raw personalID
+// ===========================================================================
+func (t *SimpleChaincode) createExposureAlert(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start create exposure alert")
+
+	type alertTransientInput struct {
+		AlertID    string `json:"alertID"`
+		PersonalID string `json:"personalID"`
+		FacilityID string `json:"facilityID"`
+		Start      string `json:"start"`
+		End        string `json:"end"`
+		Action     string `json:"action"`
+	}
+
+	if len(args) != 0 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Private alert data must be passed in transient map.")
+	}
+
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Error getting transient: %s", err.Error())
+	}
+	if len(transMap[alertTransientKey]) == 0 {
+		return errorResponse(errCodeRequired, alertTransientKey, "%s must be a key in the transient map", alertTransientKey)
+	}
+
+	var input alertTransientInput
+	err = decodeStrict(transMap[alertTransientKey], &input)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	if len(input.AlertID) == 0 {
+		input.AlertID = stub.GetTxID()
+	}
+	validations := []error{
+		validatePattern("alertID", input.AlertID, entryLogIDPattern),
+		validatePattern("facilityID", input.FacilityID, facilityIDPattern),
+		validateText("action", input.Action, maxActionLength),
+	}
+	for _, err := range validations {
+		if err != nil {
+			return toErrorResponse(err)
+		}
+	}
+
+	key, err := getPseudonymKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	personalID, err := resolvePersonalID(key, "personalID", input.PersonalID)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get config: %s", err.Error())
+	}
+	startTimestamp, endTimestamp, err := parseTimeWindow(config, input.Start, input.End)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	existing, err := readAlert(stub, input.AlertID)
+	if err != nil {
+		return toErrorResponse(err)
+	} else if existing != nil {
+		return errorResponse(errCodeAlreadyExists, "alertID", "This alert already exists: %s", input.AlertID)
+	}
+
+	createdBy, err := cid.GetID(stub)
+	if err != nil {
+		return errorResponse(errCodePermissionDenied, "", "Failed to get the ID of the caller: %s", err.Error())
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	alert := &exposureAlert{
+		ObjectType:       alertObjectType,
+		AlertID:          input.AlertID,
+		PersonalID:       personalID,
+		FacilityID:       input.FacilityID,
+		Start:            input.Start,
+		End:              input.End,
+		StartTimestamp:   startTimestamp,
+		EndTimestamp:     endTimestamp,
+		Action:           input.Action,
+		Status:           alertStatusActive,
+		CreatedBy:        createdBy,
+		CreatedTimestamp: txTime.Unix(),
+	}
+	alertAsBytes, err := putAlert(stub, alert)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	// ==== Index the alert by person ====
+	indexKey, err := stub.CreateCompositeKey(alertIndexName, []string{alert.PersonalID, alert.AlertID})
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	err = stub.PutPrivateData("collectionExposureAlerts", indexKey, []byte{0x00})
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	fmt.Println("- end create exposure alert (success)")
+	return shim.Success(alertAsBytes)
+}
+
+// ===========================================================================
+// getExposureAlerts - the alerts of a person that are not resolved, oldest first.
+// A person may only read their own, the health authority anyone's.
+// Args: personalID, "all" (optional, resolved alerts as well)
+// Transient: pseudonymKey, needed for a raw personalID
+// ===========================================================================
+func (t *SimpleChaincode) getExposureAlerts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 2 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting personalID and an optional all")
+	}
+	all := false
+	if len(args) == 2 {
+		if args[1] != "all" {
+			return errorResponse(errCodeOutOfRange, "", "the second argument can only be all")
+		}
+		all = true
+	}
+
+	key, err := getPseudonymKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	personalID, err := resolvePersonalID(key, "personalID", args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	roles, err := callerRoles(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	if !containsString(roles, roleHealthAuthority) {
+		err = assertPersonCaller(stub, key, personalID)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+	}
+
+	resultsIterator, err := stub.GetPrivateDataByPartialCompositeKey("collectionExposureAlerts", alertIndexName, []string{personalID})
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	var alerts []*exposureAlert
+	for resultsIterator.HasNext() {
+		res, err := resultsIterator.Next()
+		if err != nil {
+			return toErrorResponse(err)
+		}
+
+		_, compositeKeyParts, err := stub.SplitCompositeKey(res.Key)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+		alert, err := readAlert(stub, compositeKeyParts[1])
+		if err != nil {
+			return toErrorResponse(err)
+		} else if alert == nil {
+			continue
+		}
+		if !all && alert.Status == alertStatusResolved {
+			continue
+		}
+		alerts = append(alerts, alert)
+	}
+
+	// the index is ordered by alertID, the person reads them by creation
+	sort.SliceStable(alerts, func(i, j int) bool {
+		return alerts[i].CreatedTimestamp < alerts[j].CreatedTimestamp
+	})
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+	for i, alert := range alerts {
+		alertAsBytes, err := json.Marshal(alert)
+		if err != nil {
+			return errorResponse(errCodeInternal, "", "%s", err.Error())
+		}
+		if i > 0 {
+			buffer.WriteString(",")
+		}
+		buffer.Write(alertAsBytes)
+	}
+	buffer.WriteString("]")
+
+	return shim.Success(buffer.Bytes())
+}
+
+// ===========================================================================
+// acknowledgeExposureAlert - mark an active alert as seen by the person it is for,
+// who must be the caller, see assertPersonCaller. Args: alertID, personalID
+// Transient: pseudonymKey, needed for a raw personalID
+// ===========================================================================
+func (t *SimpleChaincode) acknowledgeExposureAlert(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 2 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting alertID and personalID")
+	}
+
+	key, err := getPseudonymKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	personalID, err := resolvePersonalID(key, "personalID", args[1])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	err = assertPersonCaller(stub, key, personalID)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	alert, err := readAlert(stub, args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	} else if alert == nil || alert.PersonalID != personalID {
+		// an alert of someone else is not revealed to exist
+		return errorResponse(errCodeNotFound, "alertID", "alert does not exist: %s", args[0])
+	}
+	return setAlertStatus(stub, alert, alertStatusAcknowledged)
+}
+
+// ===========================================================================
+// resolveExposureAlert - close an alert, the person needs to do nothing more. Args: alertID
+// ===========================================================================
+func (t *SimpleChaincode) resolveExposureAlert(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting alertID")
+	}
+
+	alert, err := readAlert(stub, args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	} else if alert == nil {
+		return errorResponse(errCodeNotFound, "alertID", "alert does not exist: %s", args[0])
+	}
+	return setAlertStatus(stub, alert, alertStatusResolved)
+}
+
+// ===========================================================================
+// setAlertStatus - move an alert to status: active alerts can be acknowledged,
+// active and acknowledged alerts can be resolved
+// ===========================================================================
+func setAlertStatus(stub shim.ChaincodeStubInterface, alert *exposureAlert, status string) pb.Response {
+	fmt.Println("- start set exposure alert " + status)
+
+	if alert.Status == alertStatusResolved || alert.Status == status {
+		return errorResponse(errCodeConflict, "alertID", "alert is already %s: %s", alert.Status, alert.AlertID)
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	alert.Status = status
+	if status == alertStatusAcknowledged {
+		alert.AcknowledgedTimestamp = txTime.Unix()
+	} else {
+		alert.ResolvedTimestamp = txTime.Unix()
+	}
+	alertAsBytes, err := putAlert(stub, alert)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	fmt.Println("- end set exposure alert " + status + " (success)")
+	return shim.Success(alertAsBytes)
+}
+
+// ===========================================================================
+// readAlert - read and decode an alert, nil if it does not exist
+// ===========================================================================
+func readAlert(stub shim.ChaincodeStubInterface, alertID string) (*exposureAlert, error) {
+	alertKey, err := stub.CreateCompositeKey(alertObjectType, []string{alertID})
+	if err != nil {
+		return nil, err
+	}
+	alertAsBytes, err := stub.GetPrivateData("collectionExposureAlerts", alertKey)
+	if err != nil {
+		return nil, err
+	} else if alertAsBytes == nil {
+		return nil, nil
+	}
+
+	alert := &exposureAlert{}
+	err = json.Unmarshal(alertAsBytes, alert)
+	if err != nil {
+		return nil, err
+	}
+	return alert, nil
+}
+
+// ===========================================================================
+// putAlert - save an alert, return the stored JSON
+// ===========================================================================
+func putAlert(stub shim.ChaincodeStubInterface, alert *exposureAlert) ([]byte, error) {
+	alertKey, err := stub.CreateCompositeKey(alertObjectType, []string{alert.AlertID})
+	if err != nil {
+		return nil, err
+	}
+
+	alertAsBytes, err := json.Marshal(alert)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutPrivateData("collectionExposureAlerts", alertKey, alertAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return alertAsBytes, nil
+}
@@ -0,0 +1,150 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// configKey is the world state key of the chaincode configuration
+const configKey = "config"
+
+const (
+	// skewPolicyReject refuses entries whose time is outside the tolerance
+	skewPolicyReject = "reject"
+	// skewPolicyFlag stores such entries with entryTimeFlagged set
+	skewPolicyFlag = "flag"
+)
+
+const (
+	// capacityPolicyOff neither tracks the occupancy of facilities nor checks their capacity
+	capacityPolicyOff = "off"
+	// capacityPolicyReject refuses entries to a facility that is at its capacity
+	capacityPolicyReject = "reject"
+	// capacityPolicyFlag stores such entries with capacityExceeded set
+	capacityPolicyFlag = "flag"
+)
+
+// chaincodeConfig holds the settings passed as JSON in the first Init argument
+// at instantiate or upgrade time. Fields left out keep their default value.
+type chaincodeConfig struct {
+	EntryTimeSkewSeconds      int64   `json:"entryTimeSkewSeconds"`      // allowed distance between entryTime and the transaction time
+	EntryTimeSkewPolicy       string  `json:"entryTimeSkewPolicy"`       // reject or flag
+	BatchEntryTimeSkewSeconds int64   `json:"batchEntryTimeSkewSeconds"` // the same for setEntryLogs, whose entries were buffered offline
+	BatchEntryTimeSkewPolicy  string  `json:"batchEntryTimeSkewPolicy"`  // reject or flag, for setEntryLogs
+	EntryTimeOffsetMinutes    int     `json:"entryTimeOffsetMinutes"`    // UTC offset of entryTime strings without a zone, KST by default
+	DefaultDwellMinutes       int64   `json:"defaultDwellMinutes"`       // stay assumed by contact tracing for entries without an exit
+	MaxDwellMinutes           int64   `json:"maxDwellMinutes"`           // longest stay contact tracing considers, longer ones are cut
+	KAnonymity                int     `json:"kAnonymity"`                // fewest distinct persons a statistics bucket may count
+	PrivacyBudget             float64 `json:"privacyBudget"`             // total epsilon each org may spend on noisy statistics
+	CapacityPolicy            string  `json:"capacityPolicy"`            // off, reject or flag entries to a full facility
+}
+
+func defaultConfig() *chaincodeConfig {
+	return &chaincodeConfig{
+		EntryTimeSkewSeconds:      300,
+		EntryTimeSkewPolicy:       skewPolicyReject,
+		BatchEntryTimeSkewSeconds: 7 * 24 * 60 * 60,
+		BatchEntryTimeSkewPolicy:  skewPolicyFlag,
+		EntryTimeOffsetMinutes:    9 * 60,
+		DefaultDwellMinutes:       60,
+		MaxDwellMinutes:           12 * 60,
+		KAnonymity:                5,
+		PrivacyBudget:             10,
+		CapacityPolicy:            capacityPolicyOff,
+	}
+}
+
+func (c *chaincodeConfig) validate() error {
+	if c.EntryTimeSkewSeconds < 0 {
+		return newError(errCodeOutOfRange, "entryTimeSkewSeconds", "entryTimeSkewSeconds must not be negative")
+	}
+	if c.EntryTimeSkewPolicy != skewPolicyReject && c.EntryTimeSkewPolicy != skewPolicyFlag {
+		return newError(errCodeOutOfRange, "entryTimeSkewPolicy", "entryTimeSkewPolicy must be %s or %s", skewPolicyReject, skewPolicyFlag)
+	}
+	if c.BatchEntryTimeSkewSeconds < 0 {
+		return newError(errCodeOutOfRange, "batchEntryTimeSkewSeconds", "batchEntryTimeSkewSeconds must not be negative")
+	}
+	if c.BatchEntryTimeSkewPolicy != skewPolicyReject && c.BatchEntryTimeSkewPolicy != skewPolicyFlag {
+		return newError(errCodeOutOfRange, "batchEntryTimeSkewPolicy", "batchEntryTimeSkewPolicy must be %s or %s", skewPolicyReject, skewPolicyFlag)
+	}
+	if c.EntryTimeOffsetMinutes < -12*60 || c.EntryTimeOffsetMinutes > 14*60 {
+		return newError(errCodeOutOfRange, "entryTimeOffsetMinutes", "entryTimeOffsetMinutes must be a valid UTC offset")
+	}
+	if c.MaxDwellMinutes < 1 || c.MaxDwellMinutes > 24*60 {
+		return newError(errCodeOutOfRange, "maxDwellMinutes", "maxDwellMinutes must be between 1 and %d", 24*60)
+	}
+	if c.DefaultDwellMinutes < 1 || c.DefaultDwellMinutes > c.MaxDwellMinutes {
+		return newError(errCodeOutOfRange, "defaultDwellMinutes", "defaultDwellMinutes must be between 1 and maxDwellMinutes")
+	}
+	if c.KAnonymity < 2 || c.KAnonymity > 100 {
+		return newError(errCodeOutOfRange, "kAnonymity", "kAnonymity must be between 2 and 100")
+	}
+	if c.PrivacyBudget < 0 {
+		return newError(errCodeOutOfRange, "privacyBudget", "privacyBudget must be a number not below 0")
+	}
+	if c.CapacityPolicy != capacityPolicyOff && c.CapacityPolicy != capacityPolicyReject && c.CapacityPolicy != capacityPolicyFlag {
+		return newError(errCodeOutOfRange, "capacityPolicy", "capacityPolicy must be %s, %s or %s", capacityPolicyOff, capacityPolicyReject, capacityPolicyFlag)
+	}
+	return nil
+}
+
+// forBatch - the config setEntryLogs validates its entries with. Readers buffer entries
+// while offline and upload them later, so a batch has its own entryTime tolerance and policy.
+func (c *chaincodeConfig) forBatch() *chaincodeConfig {
+	batch := *c
+	batch.EntryTimeSkewSeconds = c.BatchEntryTimeSkewSeconds
+	batch.EntryTimeSkewPolicy = c.BatchEntryTimeSkewPolicy
+	return &batch
+}
+
+// ===========================================================================
+// getConfig - read the chaincode configuration, defaults if none was stored
+// ===========================================================================
+func getConfig(stub shim.ChaincodeStubInterface) (*chaincodeConfig, error) {
+	config := defaultConfig()
+
+	configAsBytes, err := stub.GetState(configKey)
+	if err != nil {
+		return nil, err
+	} else if configAsBytes == nil {
+		return config, nil
+	}
+
+	err = json.Unmarshal(configAsBytes, config)
+	if err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// ===========================================================================
+// putConfig - merge configJSON over the stored configuration and save it
+// ===========================================================================
+func putConfig(stub shim.ChaincodeStubInterface, configJSON []byte) error {
+	config, err := getConfig(stub)
+	if err != nil {
+		return err
+	}
+
+	err = json.Unmarshal(configJSON, config)
+	if err != nil {
+		return newError(errCodeInvalidJSON, "", "Failed to decode config JSON: %s", err.Error())
+	}
+	err = config.validate()
+	if err != nil {
+		return err
+	}
+
+	configAsBytes, err := json.Marshal(config)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(configKey, configAsBytes)
+}
@@ -0,0 +1,247 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Contact tracing reads the time indexes: the visits of a case in a window from
+// person~time~entryLog, then the visits of each of its facilities from facility~time~entryLog.
+// A visit lasts from entryTimestamp to exitTimestamp; without a recorded exit the config's
+// defaultDwellMinutes are assumed, and no visit lasts longer than maxDwellMinutes.
+// Two visits are in contact when they overlap once the case's visit is widened by the margin.
+const maxContactMarginMinutes = 24 * 60
+
+// visit is the stay of one entryLog, in UTC epoch seconds
+type visit struct {
+	EntryLogID     string `json:"entryLogID"`
+	PersonalID     string `json:"personalID,omitempty"`
+	EntryTimestamp int64  `json:"entryTimestamp"`
+	ExitTimestamp  int64  `json:"exitTimestamp"`
+	ExitRecorded   bool   `json:"exitRecorded"` // false if exitTimestamp was assumed from defaultDwellMinutes
+}
+
+// contact is a visit that overlapped a visit of the case at the same facility
+type contact struct {
+	visit
+	CaseEntryLogID string                  `json:"caseEntryLogID"` // the visit of the case with the longest overlap
+	OverlapSeconds int64                   `json:"overlapSeconds"`
+	Details        *entryLogPrivateDetails `json:"details,omitempty"` // only for callers who may read private details
+}
+
+// facilityContacts are the visits of the case at one facility and the contacts they had
+type facilityContacts struct {
+	FacilityID string     `json:"facilityID"`
+	Visits     []*visit   `json:"visits"`
+	Contacts   []*contact `json:"contacts"`
+}
+
+// ===========================================================================
+// traceContacts - the persons who were at the facilities of a case at overlapping times.
+// Args: personalID of the case, start, end (entryTime format, the case's entries in the window),
+// marginMinutes (widens the case's visits on both sides)
+// Transient: pseudonymKey, needed for a raw personalID;
+// encryptionKey and encryptionKeyID, to decrypt the contacts' name, phone and address
+// ===========================================================================
+func (t *SimpleChaincode) traceContacts(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start trace contacts")
+
+	if len(args) != 4 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting personalID, start, end and marginMinutes")
+	}
+
+	key, err := getPseudonymKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	personalIDs, err := personalIDAliases(key, "personalID", args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get config: %s", err.Error())
+	}
+	startTimestamp, endTimestamp, err := parseTimeWindow(config, args[1], args[2])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	margin, err := parseContactMargin(args[3])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	facilities, _, err := findContacts(stub, config, personalIDs, startTimestamp, endTimestamp, margin)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	// ==== Contact details for the roles that may read private details ====
+	if authorize(stub, "getEntryLogPrivateDetails") == nil {
+		enc, err := getEncryptionKey(stub)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+		err = joinContactDetails(stub, enc, facilities)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+	}
+
+	resultAsBytes, err := json.Marshal(map[string]interface{}{
+		"personalIDs":    personalIDs,
+		"startTimestamp": startTimestamp,
+		"endTimestamp":   endTimestamp,
+		"marginMinutes":  margin / 60,
+		"facilities":     facilities,
+	})
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+
+	fmt.Printf("- end trace contacts: %d facilities\n", len(facilities))
+	return shim.Success(resultAsBytes)
+}
+
+// parseContactMargin - the marginMinutes argument in seconds
+func parseContactMargin(value string) (int64, error) {
+	margin, err := strconv.Atoi(value)
+	if err != nil || margin < 0 || margin > maxContactMarginMinutes {
+		return 0, newError(errCodeOutOfRange, "marginMinutes", "marginMinutes must be a number between 0 and %d", maxContactMarginMinutes)
+	}
+	return int64(margin) * 60, nil
+}
+
+// ===========================================================================
+// findContacts - the visits of the case, known by personalIDs, whose entry is in the window,
+// and the visits of others that overlapped them, by facility in the order of the case's visits.
+// Also returns the number of entryLogs read.
+// ===========================================================================
+func findContacts(stub shim.ChaincodeStubInterface, config *chaincodeConfig, personalIDs []string, startTimestamp int64, endTimestamp int64, margin int64) ([]*facilityContacts, int, error) {
+	caseEntries, err := readTimeWindow(stub, config, personTimeIndex, personalIDs, startTimestamp, endTimestamp)
+	if err != nil {
+		return nil, 0, err
+	}
+	reads := len(caseEntries)
+
+	var facilities []*facilityContacts
+	byFacility := make(map[string]*facilityContacts)
+	for _, entry := range caseEntries {
+		f, ok := byFacility[entry.FacilityID]
+		if !ok {
+			f = &facilityContacts{FacilityID: entry.FacilityID, Visits: []*visit{}, Contacts: []*contact{}}
+			byFacility[entry.FacilityID] = f
+			facilities = append(facilities, f)
+		}
+		f.Visits = append(f.Visits, newVisit(config, entry))
+	}
+
+	maxDwell := config.MaxDwellMinutes * 60
+	for _, f := range facilities {
+		// ==== Visits that started up to maxDwellMinutes before the case's could still overlap ====
+		first := f.Visits[0].EntryTimestamp - margin - maxDwell
+		last := first
+		for _, v := range f.Visits {
+			if v.ExitTimestamp+margin > last {
+				last = v.ExitTimestamp + margin
+			}
+		}
+		others, err := readTimeWindow(stub, config, facilityTimeIndex, []string{f.FacilityID}, first, last)
+		if err != nil {
+			return nil, 0, err
+		}
+		reads += len(others)
+
+		for _, other := range others {
+			if containsString(personalIDs, other.PersonalID) {
+				continue
+			}
+			otherVisit := newVisit(config, other)
+			var best *contact
+			for _, v := range f.Visits {
+				overlap := overlapSeconds(v.EntryTimestamp-margin, v.ExitTimestamp+margin, otherVisit.EntryTimestamp, otherVisit.ExitTimestamp)
+				if overlap > 0 && (best == nil || overlap > best.OverlapSeconds) {
+					best = &contact{visit: *otherVisit, CaseEntryLogID: v.EntryLogID, OverlapSeconds: overlap}
+				}
+			}
+			if best != nil {
+				f.Contacts = append(f.Contacts, best)
+			}
+		}
+	}
+	return facilities, reads, nil
+}
+
+// newVisit - the stay of an entryLog, see the note on contact tracing
+func newVisit(config *chaincodeConfig, entry *entryLog) *visit {
+	v := &visit{
+		EntryLogID:     entry.EntryLogID,
+		PersonalID:     entry.PersonalID,
+		EntryTimestamp: entry.EntryTimestamp,
+		ExitTimestamp:  entry.EntryTimestamp + config.DefaultDwellMinutes*60,
+	}
+	if entry.ExitTimestamp > entry.EntryTimestamp {
+		v.ExitTimestamp = entry.ExitTimestamp
+		v.ExitRecorded = true
+	}
+	if v.ExitTimestamp > entry.EntryTimestamp+config.MaxDwellMinutes*60 {
+		v.ExitTimestamp = entry.EntryTimestamp + config.MaxDwellMinutes*60
+	}
+	return v
+}
+
+// overlapSeconds - the length of the overlap of [start1, end1] and [start2, end2]
+func overlapSeconds(start1 int64, end1 int64, start2 int64, end2 int64) int64 {
+	start := start1
+	if start2 > start {
+		start = start2
+	}
+	end := end1
+	if end2 < end {
+		end = end2
+	}
+	if end < start {
+		return 0
+	}
+	return end - start
+}
+
+// ===========================================================================
+// joinContactDetails - add the private details of every contact, name, phone and address
+// decrypted with enc. Contacts whose details are gone are left without.
+// ===========================================================================
+func joinContactDetails(stub shim.ChaincodeStubInterface, enc *encryptionKey, facilities []*facilityContacts) error {
+	// a person's profile is read once for all of their entries
+	profiles := make(map[string]*personProfile)
+	for _, f := range facilities {
+		for _, c := range f.Contacts {
+			detailsAsBytes, err := stub.GetPrivateData("collectionEntryLogPrivateDetails", c.EntryLogID)
+			if err != nil {
+				return err
+			} else if detailsAsBytes == nil {
+				continue
+			}
+
+			details, _, err := readEntryLogPrivateDetails(detailsAsBytes)
+			if err != nil {
+				return err
+			}
+			err = joinPersonProfile(stub, enc, details, profiles)
+			if err != nil {
+				return err
+			}
+			c.Details = details
+		}
+	}
+	return nil
+}
@@ -0,0 +1,203 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The contact graph repeats findContacts breadth first: the contacts of the seed are hop 1,
+// their contacts hop 2 and so on, all within the same window. A person is one node under
+// all its aliases, a raw personalID not migrated yet and its pseudonym, and each alias is
+// expanded once. The expansion stops at maxHops, once maxNodes persons are in the graph or
+// once maxGraphReads entryLogs were read in total, in the last two cases the graph is
+// marked truncated.
+const (
+	maxGraphHops  = 5
+	maxGraphNodes = 500
+	maxGraphReads = 20000
+)
+
+type graphPerson struct {
+	PersonalID string `json:"personalID"`
+	Hop        int    `json:"hop"` // 0 for the seed
+}
+
+// graphNode is a person of the graph with the aliases it is known by
+type graphNode struct {
+	person  *graphPerson
+	aliases []string
+	pending []string // aliases not expanded yet
+	queued  bool
+}
+
+// graphEdge is a co-location of two persons, each edge is listed once
+type graphEdge struct {
+	From           string `json:"from"` // personalID of the person expanded
+	To             string `json:"to"`
+	FacilityID     string `json:"facilityID"`
+	FromEntryLogID string `json:"fromEntryLogID"`
+	ToEntryLogID   string `json:"toEntryLogID"`
+	OverlapSeconds int64  `json:"overlapSeconds"`
+	Hop            int    `json:"hop"` // hop of the From person plus one
+}
+
+// ===========================================================================
+// traceContactGraph - expand the contacts of a seed person over several hops.
+// Args: personalID of the seed, start, end (entryTime format), marginMinutes, maxHops, maxNodes
+// Transient: pseudonymKey, needed for a raw personalID
+// ===========================================================================
+func (t *SimpleChaincode) traceContactGraph(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start trace contact graph")
+
+	if len(args) != 6 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting personalID, start, end, marginMinutes, maxHops and maxNodes")
+	}
+
+	key, err := getPseudonymKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	seedIDs, err := personalIDAliases(key, "personalID", args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	config, err := getConfig(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get config: %s", err.Error())
+	}
+	startTimestamp, endTimestamp, err := parseTimeWindow(config, args[1], args[2])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	margin, err := parseContactMargin(args[3])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	maxHops, err := strconv.Atoi(args[4])
+	if err != nil || maxHops < 1 || maxHops > maxGraphHops {
+		return errorResponse(errCodeOutOfRange, "maxHops", "maxHops must be a number between 1 and %d", maxGraphHops)
+	}
+	maxNodes, err := strconv.Atoi(args[5])
+	if err != nil || maxNodes < 2 || maxNodes > maxGraphNodes {
+		return errorResponse(errCodeOutOfRange, "maxNodes", "maxNodes must be a number between 2 and %d", maxGraphNodes)
+	}
+
+	// ==== Breadth first, the aliases of a person are one node ====
+	seed := &graphNode{person: &graphPerson{PersonalID: seedIDs[0], Hop: 0}, aliases: seedIDs, pending: seedIDs, queued: true}
+	persons := []*graphPerson{seed.person}
+	nodes := make(map[string]*graphNode)
+	for _, personalID := range seedIDs {
+		nodes[personalID] = seed
+	}
+	facilities := []string{}
+	edges := []*graphEdge{}
+	edgeSeen := make(map[string]bool)
+	truncated := false
+	reads := 0
+
+	queue := []*graphNode{seed}
+	for len(queue) != 0 && !truncated {
+		from := queue[0]
+		queue = queue[1:]
+		if reads >= maxGraphReads {
+			truncated = true
+			break
+		}
+		ids := from.pending
+		from.pending = nil
+		from.queued = false
+		contacts, n, err := findContacts(stub, config, ids, startTimestamp, endTimestamp, margin)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+		reads += n
+
+		hop := from.person.Hop + 1
+		for _, f := range contacts {
+			for _, c := range f.Contacts {
+				// ==== A raw personalID is collapsed with its pseudonym when the key is at hand ====
+				contactIDs := []string{c.PersonalID}
+				if key != nil {
+					contactIDs, err = personalIDAliases(key, "personalID", c.PersonalID)
+					if err != nil {
+						return toErrorResponse(err)
+					}
+				}
+				to := nodes[contactIDs[0]]
+				if to == nil {
+					to = nodes[c.PersonalID]
+				}
+				if to == nil {
+					if len(persons) == maxNodes {
+						truncated = true
+						continue
+					}
+					to = &graphNode{person: &graphPerson{PersonalID: contactIDs[0], Hop: hop}}
+					persons = append(persons, to.person)
+				}
+				for _, personalID := range contactIDs {
+					if containsString(to.aliases, personalID) {
+						continue
+					}
+					nodes[personalID] = to
+					to.aliases = append(to.aliases, personalID)
+					to.pending = append(to.pending, personalID)
+				}
+				if len(to.pending) != 0 && !to.queued && to.person.Hop < maxHops {
+					to.queued = true
+					queue = append(queue, to)
+				}
+				if to == from {
+					// the person's records under another alias
+					continue
+				}
+
+				// the same co-location is found again from the other side
+				edgeKey := c.CaseEntryLogID + "\x00" + c.EntryLogID
+				if c.EntryLogID < c.CaseEntryLogID {
+					edgeKey = c.EntryLogID + "\x00" + c.CaseEntryLogID
+				}
+				if edgeSeen[edgeKey] {
+					continue
+				}
+				edgeSeen[edgeKey] = true
+				if !containsString(facilities, f.FacilityID) {
+					facilities = append(facilities, f.FacilityID)
+				}
+				edges = append(edges, &graphEdge{
+					From:           from.person.PersonalID,
+					To:             to.person.PersonalID,
+					FacilityID:     f.FacilityID,
+					FromEntryLogID: c.CaseEntryLogID,
+					ToEntryLogID:   c.EntryLogID,
+					OverlapSeconds: c.OverlapSeconds,
+					Hop:            hop,
+				})
+			}
+		}
+	}
+
+	resultAsBytes, err := json.Marshal(map[string]interface{}{
+		"seed":       seedIDs[0],
+		"persons":    persons,
+		"facilities": facilities,
+		"edges":      edges,
+		"truncated":  truncated,
+	})
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+
+	fmt.Printf("- end trace contact graph: %d persons, %d edges, %d entryLogs read\n", len(persons), len(edges), reads)
+	return shim.Success(resultAsBytes)
+}
@@ -0,0 +1,168 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"regexp"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Name, phone and address of a person profile are stored AES-GCM encrypted.
+// Writers pass the AES key (16, 24 or 32 bytes) and its ID in the transient map;
+// the profile keeps the ciphertext and the key ID only. Readers that pass the same
+// key get the fields decrypted, others see the key ID the fields are encrypted under.
+const (
+	encryptionKeyTransientKey   = "encryptionKey"
+	encryptionKeyIDTransientKey = "encryptionKeyID"
+)
+
+var encryptionKeyIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]{0,63}$`)
+
+type encryptionKey struct {
+	id  string
+	key []byte
+}
+
+// personalInformation is the plaintext sealed into a profile's ciphertext
+type personalInformation struct {
+	Name    string `json:"name"`
+	Phone   string `json:"phone"`
+	Address string `json:"address"`
+}
+
+// ===========================================================================
+// getEncryptionKey - the encryption key of the transient map, nil if none was passed
+// ===========================================================================
+func getEncryptionKey(stub shim.ChaincodeStubInterface) (*encryptionKey, error) {
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+	key, hasKey := transMap[encryptionKeyTransientKey]
+	keyID, hasKeyID := transMap[encryptionKeyIDTransientKey]
+	if !hasKey && !hasKeyID {
+		return nil, nil
+	}
+
+	if !hasKey {
+		return nil, newError(errCodeRequired, encryptionKeyTransientKey, "%s must be a key in the transient map together with %s", encryptionKeyTransientKey, encryptionKeyIDTransientKey)
+	}
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, newError(errCodeOutOfRange, encryptionKeyTransientKey, "%s must be an AES key of 16, 24 or 32 bytes", encryptionKeyTransientKey)
+	}
+	err = validatePattern(encryptionKeyIDTransientKey, string(keyID), encryptionKeyIDPattern)
+	if err != nil {
+		return nil, err
+	}
+	return &encryptionKey{id: string(keyID), key: key}, nil
+}
+
+// ===========================================================================
+// requireEncryptionKey - the encryption key of the transient map, which must be passed
+// ===========================================================================
+func requireEncryptionKey(stub shim.ChaincodeStubInterface) (*encryptionKey, error) {
+	enc, err := getEncryptionKey(stub)
+	if err != nil {
+		return nil, err
+	} else if enc == nil {
+		return nil, newError(errCodeRequired, encryptionKeyTransientKey, "%s and %s must be keys in the transient map", encryptionKeyTransientKey, encryptionKeyIDTransientKey)
+	}
+	return enc, nil
+}
+
+// ===========================================================================
+// sealPersonProfile - replace the name, phone and address of profile with their ciphertext.
+// Endorsers must produce the same ciphertext, so the nonce is derived from the key,
+// the transaction ID, the person and the plaintext instead of being random.
+// ===========================================================================
+func sealPersonProfile(stub shim.ChaincodeStubInterface, enc *encryptionKey, profile *personProfile) error {
+	plaintext, err := json.Marshal(&personalInformation{
+		Name:    profile.Name,
+		Phone:   profile.Phone,
+		Address: profile.Address,
+	})
+	if err != nil {
+		return err
+	}
+
+	aead, err := newProfileAEAD(enc)
+	if err != nil {
+		return err
+	}
+	additionalData := []byte(personProfileObjectType + "\x00" + profile.PersonalID)
+
+	mac := hmac.New(sha256.New, enc.key)
+	mac.Write([]byte(stub.GetTxID()))
+	mac.Write([]byte{0x00})
+	mac.Write(additionalData)
+	mac.Write([]byte{0x00})
+	mac.Write(plaintext)
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+
+	sealed := aead.Seal(nonce, nonce, plaintext, additionalData)
+	profile.KeyID = enc.id
+	profile.Ciphertext = base64.StdEncoding.EncodeToString(sealed)
+	profile.Name = ""
+	profile.Phone = ""
+	profile.Address = ""
+	return nil
+}
+
+// ===========================================================================
+// openPersonProfile - decrypt the name, phone and address of profile in place.
+// A profile in clear, or encrypted under another key ID than enc, is left as it is.
+// ===========================================================================
+func openPersonProfile(enc *encryptionKey, profile *personProfile) error {
+	if len(profile.Ciphertext) == 0 || enc == nil || enc.id != profile.KeyID {
+		return nil
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(profile.Ciphertext)
+	if err != nil {
+		return err
+	}
+	aead, err := newProfileAEAD(enc)
+	if err != nil {
+		return err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return newError(errCodeInternal, "", "ciphertext of person profile %s is too short", profile.PersonalID)
+	}
+	additionalData := []byte(personProfileObjectType + "\x00" + profile.PersonalID)
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], additionalData)
+	if err != nil {
+		return newError(errCodePermissionDenied, encryptionKeyTransientKey, "%s does not decrypt the person profile, it is not key %s", encryptionKeyTransientKey, enc.id)
+	}
+
+	info := personalInformation{}
+	err = json.Unmarshal(plaintext, &info)
+	if err != nil {
+		return err
+	}
+	profile.Name = info.Name
+	profile.Phone = info.Phone
+	profile.Address = info.Address
+	profile.KeyID = ""
+	profile.Ciphertext = ""
+	return nil
+}
+
+func newProfileAEAD(enc *encryptionKey) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(enc.key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
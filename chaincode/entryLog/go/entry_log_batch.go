@@ -0,0 +1,164 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+const (
+	// batchModeAllOrNothing fails the whole transaction if any entry is rejected
+	batchModeAllOrNothing = "allOrNothing"
+	// batchModeBestEffort writes every valid entry and reports the rejected ones
+	batchModeBestEffort = "bestEffort"
+
+	// maxEntryLogBatchSize bounds the size of a single setEntryLogs transaction
+	maxEntryLogBatchSize = 500
+)
+
+type entryLogBatchResult struct {
+	Index      int             `json:"index"`
+	EntryLogID string          `json:"entryLogID"`
+	Status     string          `json:"status"` // "ok" or "rejected"
+	Error      *chaincodeError `json:"error,omitempty"`
+}
+
+// ============================================================
+// setEntryLogs - create a batch of entryLogs in one transaction
+// ============================================================
+func (t *SimpleChaincode) setEntryLogs(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start init entry log batch")
+
+	type entryLogBatchTransientInput struct {
+		Mode      string            `json:"mode"`      // allOrNothing (default) or bestEffort
+		EntryLogs []json.RawMessage `json:"entryLogs"` // decoded one by one so each entry gets its own result
+	}
+
+	if len(args) != 0 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Private entry log data must be passed in transient map.")
+	}
+
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Error getting transient: %s", err.Error())
+	}
+
+	if _, ok := transMap["entryLogs"]; !ok {
+		return errorResponse(errCodeRequired, "entryLogs", "entryLogs must be a key in the transient map")
+	}
+
+	if len(transMap["entryLogs"]) == 0 {
+		return errorResponse(errCodeRequired, "entryLogs", "entryLogs value in the transient map must be a non-empty JSON string")
+	}
+
+	var batchInput entryLogBatchTransientInput
+	err = decodeStrict(transMap["entryLogs"], &batchInput)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	if len(batchInput.Mode) == 0 {
+		batchInput.Mode = batchModeAllOrNothing
+	}
+	if batchInput.Mode != batchModeAllOrNothing && batchInput.Mode != batchModeBestEffort {
+		return errorResponse(errCodeOutOfRange, "mode", "mode field must be %s or %s", batchModeAllOrNothing, batchModeBestEffort)
+	}
+	if len(batchInput.EntryLogs) == 0 {
+		return errorResponse(errCodeRequired, "entryLogs", "entryLogs field must be a non-empty array")
+	}
+	if len(batchInput.EntryLogs) > maxEntryLogBatchSize {
+		return errorResponse(errCodeOutOfRange, "entryLogs", "entryLogs field must not hold more than %d entries", maxEntryLogBatchSize)
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get config: %s", err.Error())
+	}
+	config = config.forBatch()
+	reader, err := getReader(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	key, err := getPseudonymKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	enc, err := requireEncryptionKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	// ==== Validate every entry before anything is written ====
+	// Writes of this transaction are not visible to its own reads,
+	// so duplicates, tag read counters and occupancies inside the batch are tracked here.
+	entryLogInputs := make([]entryLogTransientInput, len(batchInput.EntryLogs))
+	results := make([]entryLogBatchResult, len(batchInput.EntryLogs))
+	seen := make(map[string]bool)
+	tagCounters := make(map[string]int)
+	occupancies := make(map[string]*facilityOccupancy)
+	rejected := 0
+	for i := range batchInput.EntryLogs {
+		entryLogInput := &entryLogInputs[i]
+		results[i] = entryLogBatchResult{Index: i, Status: "ok"}
+
+		err = decodeStrict(batchInput.EntryLogs[i], entryLogInput)
+		if err == nil {
+			if len(entryLogInput.EntryLogID) == 0 {
+				entryLogInput.EntryLogID = newEntryLogID(stub, i)
+			}
+			results[i].EntryLogID = entryLogInput.EntryLogID
+
+			// a duplicate is rejected before it could be counted in
+			if seen[entryLogInput.EntryLogID] {
+				err = newError(errCodeAlreadyExists, "entryLogID", "This entry log appears more than once in the batch: %s", entryLogInput.EntryLogID)
+			} else {
+				err = validateEntryLogInput(stub, config, reader, key, tagCounters, occupancies, entryLogInput)
+			}
+		}
+		if err != nil {
+			inputErr, ok := err.(*chaincodeError)
+			if !ok {
+				// not a problem of this entry, the ledger could not be read
+				return errorResponse(errCodeLedgerError, "", "entryLogs[%d]: %s", i, err.Error())
+			}
+			if batchInput.Mode == batchModeAllOrNothing {
+				inputErr.Field = "entryLogs[" + strconv.Itoa(i) + "]." + inputErr.Field
+				return toErrorResponse(inputErr)
+			}
+			results[i].Status = "rejected"
+			results[i].Error = inputErr
+			rejected++
+			continue
+		}
+		seen[entryLogInput.EntryLogID] = true
+	}
+
+	// ==== Save the accepted entries and their indexes ====
+	profiles := make(map[string]*personProfile)
+	for i := range entryLogInputs {
+		if results[i].Status != "ok" {
+			continue
+		}
+		err = putEntryLog(stub, enc, occupancies, profiles, &entryLogInputs[i])
+		if err != nil {
+			return errorResponse(errCodeLedgerError, "", "entryLogs[%d]: %s", i, err.Error())
+		}
+	}
+
+	resultsAsBytes, err := json.Marshal(results)
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+
+	fmt.Printf("- end init entry log batch: %d saved, %d rejected\n", len(results)-rejected, rejected)
+	return shim.Success(resultsAsBytes)
+}
@@ -12,6 +12,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"time"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	pb "github.com/hyperledger/fabric/protos/peer"
@@ -23,22 +25,34 @@ type SimpleChaincode struct {
 
 type entryLog struct {
 	ObjectType string `json:"docType"`	 	// docType is used to distinguish the various types of objects in state database
-	EntryLogID string `json:"entryLogID`	// entryLog1, entryLog2, entryLog3, ...
-	FacilityID string `json:"facilityID` 	// the fieldtags are needed to keep case from bouncing around
+	SchemaVersion int `json:"schemaVersion,omitempty"` // see entryLogSchemaVersion
+	EntryLogID string `json:"entryLogID"`	// entryLog1, entryLog2, entryLog3, ...
+	FacilityID string `json:"facilityID"` 	// the fieldtags are needed to keep case from bouncing around
 	PersonalID string `json:"personalID"`   // the fieldtags are needed to keep case from bouncing around
+	TagUID     string `json:"tagUID,omitempty"`	// the NFC tag the entry was read from, if any
+	ReaderID   string `json:"readerID,omitempty"`	// cid ID of the reader that submitted the entry
 	Year       string `json:"year"`    
 	Gender     string `json:"gender"`
 	EntryTime  string `json:"entryTime"`
+	EntryTimestamp   int64 `json:"entryTimestamp,omitempty"`   // entryTime as UTC epoch seconds
+	EntryTimeFlagged bool  `json:"entryTimeFlagged,omitempty"` // entryTime was outside the skew tolerance
+	CapacityExceeded bool  `json:"capacityExceeded,omitempty"` // the facility was at its capacity, see capacityPolicy
+	ExitTime   string `json:"exitTime,omitempty"`     // set by recordExit when the person checks out
+	ExitTimestamp    int64 `json:"exitTimestamp,omitempty"`
+	ExitTimeFlagged  bool  `json:"exitTimeFlagged,omitempty"`
+	DwellSeconds int64 `json:"dwellSeconds"` // time between entryTime and exitTime, 0 until the exit is recorded
 }
 
 type entryLogPrivateDetails struct {
 	ObjectType string `json:"docType"` 		// docType is used to distinguish the various types of objects in state database
-	EntryLogID string `json:"entryLogID`	// entryLog1, entryLog2, entryLog3, ...
-	FacilityID string `json:"facilityID` 	// the fieldtags are needed to keep case from bouncing around
+	SchemaVersion int `json:"schemaVersion,omitempty"` // see entryLogSchemaVersion
+	EntryLogID string `json:"entryLogID"`	// entryLog1, entryLog2, entryLog3, ...
+	FacilityID string `json:"facilityID"` 	// the fieldtags are needed to keep case from bouncing around
 	PersonalID string `json:"personalID"`   // the fieldtags are needed to keep case from bouncing around
-	Name       string `json:"name"`   	
-	Phone      string `json:"phone"`
-	Address	   string `json:"address"`
+	Name       string `json:"name,omitempty"`   	// name, phone and address are read from the person's profile,
+	Phone      string `json:"phone,omitempty"`	// records before schema version 4 carry their own copy
+	Address	   string `json:"address,omitempty"`
+	KeyID      string `json:"keyID,omitempty"`	// set on reads when name, phone and address stay encrypted under this key
 }
 
 // ===================================================================================
@@ -54,6 +68,15 @@ func main() {
 // Init initializes chaincode
 // ===========================
 func (t *SimpleChaincode) Init(stub shim.ChaincodeStubInterface) pb.Response {
+	_, args := stub.GetFunctionAndParameters()
+
+	// an optional JSON config, see chaincodeConfig; without it the stored config is kept
+	if len(args) > 0 && len(args[0]) > 0 {
+		err := putConfig(stub, []byte(args[0]))
+		if err != nil {
+			return toErrorResponse(err)
+		}
+	}
 	return shim.Success(nil)
 }
 
@@ -63,20 +86,36 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 	function, args := stub.GetFunctionAndParameters()
 	fmt.Println("invoke is running " + function)
 
+	// Only the roles declared in functionRoles may call a function
+	err := authorize(stub, function)
+	if err != nil {
+		fmt.Println("invoke denied " + function)
+		return toErrorResponse(err)
+	}
+
 	// Handle different functions
 	switch function {
 	case "setEntryLog":
 		//create a new entryLog
 		return t.setEntryLog(stub, args)
+	case "setEntryLogs":
+		//create a batch of entryLogs
+		return t.setEntryLogs(stub, args)
 	case "getEntryLog":
 		//read a entryLog
 		return t.getEntryLog(stub, args)
 	case "getEntryLogPrivateDetails":
 		//read a entryLog private details
 		return t.getEntryLogPrivateDetails(stub, args)
+	case "getPersonProfile":
+		//read the name, phone and address of a person
+		return t.getPersonProfile(stub, args)
 	case "updateAddress":
-		//change owner of a specific entryLog
+		//change the address of a person, for all of their entryLogs
 		return t.updateAddress(stub, args)
+	case "recordExit":
+		//check out of an open entryLog
+		return t.recordExit(stub, args)
 	case "delete":
 		//delete a entryLog
 		return t.delete(stub, args)
@@ -93,139 +132,340 @@ func (t *SimpleChaincode) Invoke(stub shim.ChaincodeStubInterface) pb.Response {
 		return t.getPrivateEntryLogByFacility(stub, args)
 	case "getPrivateEntryLogByPerson":
 		return t.getPrivateEntryLogByPerson(stub, args)
+	case "queryEntryLogsByFacilityTime":
+		//find the entryLogs of a facility within a time window
+		return t.queryEntryLogsByFacilityTime(stub, args)
+	case "queryEntryLogsByPersonTime":
+		//find the entryLogs of a person within a time window
+		return t.queryEntryLogsByPersonTime(stub, args)
+	case "traceContacts":
+		//find the persons who were at the facilities of a case at the same time
+		return t.traceContacts(stub, args)
+	case "traceContactGraph":
+		//expand the contacts of a case over several hops
+		return t.traceContactGraph(stub, args)
+	case "createExposureAlert":
+		//notify a person of an exposure found by tracing
+		return t.createExposureAlert(stub, args)
+	case "getExposureAlerts":
+		//read the alerts of a person
+		return t.getExposureAlerts(stub, args)
+	case "acknowledgeExposureAlert":
+		return t.acknowledgeExposureAlert(stub, args)
+	case "resolveExposureAlert":
+		return t.resolveExposureAlert(stub, args)
+	case "getVisitStatistics":
+		//count the visits of a facility by day, hour, gender and birth decade
+		return t.getVisitStatistics(stub, args)
+	case "getVisitStatisticsResult":
+		//read noisy statistics once their transaction is committed
+		return t.getVisitStatisticsResult(stub, args)
+	case "getPrivacyBudget":
+		return t.getPrivacyBudget(stub, args)
+	case "setPrivacyBudget":
+		//change the epsilon an org may spend on noisy statistics
+		return t.setPrivacyBudget(stub, args)
+	case "setNoiseSeed":
+		//set the secret noisy statistics are drawn with
+		return t.setNoiseSeed(stub, args)
+	case "getOccupancy":
+		//count the persons inside a facility
+		return t.getOccupancy(stub, args)
+	case "setOccupancy":
+		//correct the count of a facility
+		return t.setOccupancy(stub, args)
+	case "migrateEntryLogs":
+		//upgrade stored entryLogs to the current schema
+		return t.migrateEntryLogs(stub, args)
+	case "registerPseudonymKey":
+		//fix the key personalIDs are pseudonymized with
+		return t.registerPseudonymKey(stub, args)
+	case "registerFacility":
+		//add a facility to the registry
+		return t.registerFacility(stub, args)
+	case "updateFacility":
+		//change a facility of the caller's org
+		return t.updateFacility(stub, args)
+	case "getFacility":
+		return t.getFacility(stub, args)
+	case "listFacilities":
+		return t.listFacilities(stub, args)
+	case "registerTag":
+		//bind an NFC tag to an entrance of a facility
+		return t.registerTag(stub, args)
+	case "revokeTag":
+		//stop accepting entries from an NFC tag
+		return t.revokeTag(stub, args)
+	case "listTags":
+		return t.listTags(stub, args)
 	default:
 		//error
 		fmt.Println("invoke did not find func: " + function)
-		return shim.Error("Received unknown function invocation")
+		return errorResponse(errCodeUnknownFunction, "", "Received unknown function invocation: %s", function)
 	}
 }
 
+type entryLogTransientInput struct {
+	EntryLogID string `json:"entryLogID"`	// optional, assigned from the transaction ID when empty
+	FacilityID string `json:"facilityID"` 	// the fieldtags are needed to keep case from bouncing around
+	TagUID     string `json:"tagUID"`	// optional, the facility is taken from the tag when given
+	PICCData   string `json:"piccData"`	// SUN message of NTAG 424 DNA tags, hex
+	CMAC       string `json:"cmac"`
+	Year       string `json:"year"`    
+	Gender     string `json:"gender"`
+	EntryTime  string `json:"entryTime"`
+// ***************************************
+	PersonalID string `json:"personalID"`   // the fieldtags are needed to keep case from bouncing around
+	Name       string `json:"name"`   	
+	Phone      string `json:"phone"`
+	Address	   string `json:"address"`
+
+	entryTimestamp   int64 // filled in by validateEntryLogInput
+	entryTimeFlagged bool
+	readerID         string
+	countedIn        bool // filled in by checkCapacity
+	capacityExceeded bool
+	sun              *tagSUN // filled in by verifyTagSUN, with the counter of this read
+}
+
 // ============================================================
-// setEntryLog - create a new entryLog, store into chaincode state
+// setEntryLog - create a new entryLog, store into chaincode state.
+// The submitter must be a reader of the entryLog's facility, see getReader.
 // ============================================================
 func (t *SimpleChaincode) setEntryLog(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	var err error
 
-	type entryLogTransientInput struct {
-		EntryLogID string `json:"entryLogID`	// entryLog1, entryLog2, entryLog3, ...
-		FacilityID string `json:"facilityID` 	// the fieldtags are needed to keep case from bouncing around
-		Year       string `json:"year"`    
-		Gender     string `json:"gender"`
-		EntryTime  string `json:"entryTime"`
-	// ***************************************
-		PersonalID string `json:"personalID"`   // the fieldtags are needed to keep case from bouncing around
-		Name       string `json:"name"`   	
-		Phone      string `json:"phone"`
-		Address	   string `json:"address"`
-	}
-
 	// ==== Input sanitation ====
 	fmt.Println("- start init entry log")
 
 	if len(args) != 0 {
-		return shim.Error("Incorrect number of arguments. Private entry log data must be passed in transient map.")
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Private entry log data must be passed in transient map.")
 	}
 
 	transMap, err := stub.GetTransient()
 	if err != nil {
-		return shim.Error("Error getting transient: " + err.Error())
+		return errorResponse(errCodeLedgerError, "", "Error getting transient: %s", err.Error())
 	}
 
 	if _, ok := transMap["entryLog"]; !ok {
-		return shim.Error("entry log must be a key in the transient map")
+		return errorResponse(errCodeRequired, "entryLog", "entry log must be a key in the transient map")
 	}
 
 	if len(transMap["entryLog"]) == 0 {
-		return shim.Error("entry log value in the transient map must be a non-empty JSON string")
+		return errorResponse(errCodeRequired, "entryLog", "entry log value in the transient map must be a non-empty JSON string")
 	}
 
 	var entryLogInput entryLogTransientInput
-	err = json.Unmarshal(transMap["entryLog"], &entryLogInput)
+	err = decodeStrict(transMap["entryLog"], &entryLogInput)
 	if err != nil {
-		return shim.Error("Failed to decode JSON of: " + string(transMap["entryLog"]))
+		return toErrorResponse(err)
 	}
 
 	if len(entryLogInput.EntryLogID) == 0 {
-		return shim.Error("entryLogID field must be a non-empty string")
+		entryLogInput.EntryLogID = newEntryLogID(stub, -1)
 	}
-	if len(entryLogInput.FacilityID) == 0 {
-		return shim.Error("facilityID field must be a non-empty string")
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get config: %s", err.Error())
 	}
-	if len(entryLogInput.Year) == 0 {
-		return shim.Error("year field must be a non-empty string")
+	reader, err := getReader(stub)
+	if err != nil {
+		return toErrorResponse(err)
 	}
-	if len(entryLogInput.Gender) == 0 {
-		return shim.Error("gender field must be a non-empty string")
+	key, err := getPseudonymKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	enc, err := requireEncryptionKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
 	}
-	if len(entryLogInput.EntryTime) == 0 {
-		return shim.Error("entryIndex field must be a non-empty string")
+
+	occupancies := make(map[string]*facilityOccupancy)
+	err = validateEntryLogInput(stub, config, reader, key, make(map[string]int), occupancies, &entryLogInput)
+	if err != nil {
+		return toErrorResponse(err)
 	}
-	if len(entryLogInput.PersonalID) == 0 {
-		return shim.Error("personalID field must be a non-empty string")
+
+	err = putEntryLog(stub, enc, occupancies, make(map[string]*personProfile), &entryLogInput)
+	if err != nil {
+		return toErrorResponse(err)
 	}
-	if len(entryLogInput.Name) == 0 {
-		return shim.Error("name field must be a non-empty string")
+
+	// ==== entryLog saved and indexed. Return the ID it was saved under and the person's pseudonym ====
+	resultAsBytes, err := json.Marshal(map[string]string{"entryLogID": entryLogInput.EntryLogID, "personalID": entryLogInput.PersonalID})
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
 	}
-	if len(entryLogInput.Phone) == 0 {
-		return shim.Error("phone field must be a non-empty string")
+
+	fmt.Println("- end init entryLog")
+	return shim.Success(resultAsBytes)
+}
+
+// ============================================================
+// newEntryLogID - ledger-assigned ID for an entryLog the client did not name.
+// The transaction ID is unique on the channel, so app instances can no longer collide.
+// Entries of a batch get their position appended; a single entry passes index -1.
+// ============================================================
+func newEntryLogID(stub shim.ChaincodeStubInterface, index int) string {
+	if index < 0 {
+		return stub.GetTxID()
 	}
-	if len(entryLogInput.Address) == 0 {
-		return shim.Error("address field must be a non-empty string")
+	return stub.GetTxID() + "-" + strconv.Itoa(index)
+}
+
+// ============================================================
+// validateEntryLogInput - check the fields of a new entryLog and that its ID is still free,
+// take its facility from its NFC tag, if any, and check it is the reader's,
+// then replace its personalID with the pseudonym under key.
+// tagCounters holds the SUN read counters accepted earlier in the transaction, by tagUID,
+// occupancies the facility occupancies, see checkCapacity.
+// Invalid input is reported as a *chaincodeError, any other error is a ledger failure.
+// ============================================================
+func validateEntryLogInput(stub shim.ChaincodeStubInterface, config *chaincodeConfig, reader *readerIdentity, key []byte, tagCounters map[string]int, occupancies map[string]*facilityOccupancy, entryLogInput *entryLogTransientInput) error {
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return err
 	}
+	currentYear := txTime.In(time.FixedZone("", config.EntryTimeOffsetMinutes*60)).Year()
+
+	err = validateRequired("entryLogID", entryLogInput.EntryLogID)
+	if err != nil {
+		return err
+	}
+	if len(entryLogInput.TagUID) != 0 || len(entryLogInput.PICCData) != 0 {
+		err = resolveTagFacility(stub, entryLogInput, tagCounters)
+		if err != nil {
+			return err
+		}
+	}
+	err = validateEntryLogFields(entryLogInput, currentYear)
+	if err != nil {
+		return err
+	}
+	err = assertReaderFacility(reader, entryLogInput.FacilityID)
+	if err != nil {
+		return err
+	}
+	registered, err := checkFacilityActive(stub, entryLogInput.FacilityID)
+	if err != nil {
+		return err
+	}
+	if registered.SUNRequired && entryLogInput.sun == nil {
+		return newError(errCodeRequired, "piccData", "facility %s only accepts SUN reads of its tags, tagUID, piccData and cmac fields are required", entryLogInput.FacilityID)
+	}
+	if len(entryLogInput.TagUID) == 0 {
+		tagged, err := hasActiveTags(stub, entryLogInput.FacilityID)
+		if err != nil {
+			return err
+		} else if tagged {
+			return newError(errCodeRequired, "tagUID", "facility %s has registered tags, entries must be read from one of them", entryLogInput.FacilityID)
+		}
+	}
+	entryLogInput.readerID = reader.id
+	entryLogInput.PersonalID, err = resolvePersonalID(key, "personalID", entryLogInput.PersonalID)
+	if err != nil {
+		return err
+	}
+
+	entryTimestamp, entryTimeFlagged, err := checkEntryTime(stub, config, "entryTime", entryLogInput.EntryTime)
+	if err != nil {
+		return err
+	}
+	entryLogInput.entryTimestamp = entryTimestamp
+	entryLogInput.entryTimeFlagged = entryTimeFlagged
 
 	// ==== Check if entryLog already exists ====
 	entryLogAsBytes, err := stub.GetPrivateData("collectionEntryLog", entryLogInput.EntryLogID)
 	if err != nil {
-		return shim.Error("Failed to get entry log: " + err.Error())
+		return fmt.Errorf("Failed to get entry log: %s", err.Error())
 	} else if entryLogAsBytes != nil {
 		fmt.Println("This entry log already exists: " + entryLogInput.EntryLogID)
-		return shim.Error("This entry log already exists: " + entryLogInput.EntryLogID)
+		return newError(errCodeAlreadyExists, "entryLogID", "This entry log already exists: %s", entryLogInput.EntryLogID)
+	}
+
+	// ==== Count the person in, last, so a rejected entry is never counted ====
+	err = checkCapacity(stub, config, occupancies, entryLogInput)
+	if err != nil {
+		return err
+	}
+
+	// ==== The entry is accepted, a later read of its tag must have a higher counter ====
+	if entryLogInput.sun != nil {
+		tagCounters[entryLogInput.TagUID] = entryLogInput.sun.ReadCounter
 	}
+	return nil
+}
 
+// ============================================================
+// putEntryLog - write a validated entryLog, its private details and its indexes.
+// The person's name, phone and address are encrypted with enc.
+// occupancies are those counted by validateEntryLogInput, profiles caches the person
+// profiles written earlier in the transaction, see updatePersonProfile.
+// ============================================================
+func putEntryLog(stub shim.ChaincodeStubInterface, enc *encryptionKey, occupancies map[string]*facilityOccupancy, profiles map[string]*personProfile, entryLogInput *entryLogTransientInput) error {
 	// ==== Create entryLog object, marshal to JSON, and save to state ====
 	entryLog := &entryLog{
 		ObjectType: "entryLog",
+		SchemaVersion: entryLogSchemaVersion,
 		EntryLogID: entryLogInput.EntryLogID,
 		FacilityID: entryLogInput.FacilityID,
 		PersonalID: entryLogInput.PersonalID,
+		TagUID:     entryLogInput.TagUID,
+		ReaderID:   entryLogInput.readerID,
 		Year:		entryLogInput.Year,      
 		Gender:		entryLogInput.Gender,      
 		EntryTime:	entryLogInput.EntryTime,
+		EntryTimestamp:   entryLogInput.entryTimestamp,
+		EntryTimeFlagged: entryLogInput.entryTimeFlagged,
+		CapacityExceeded: entryLogInput.capacityExceeded,
 	}
 	entryLogJSONasBytes, err := json.Marshal(entryLog)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
 
 	// === Save entryLog to state ===
 	err = stub.PutPrivateData("collectionEntryLog", entryLogInput.EntryLogID, entryLogJSONasBytes)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
+	}
+
+	// ==== Save the person's name, phone and address once, encrypted, in their profile, unless it is newer ====
+	profile := &personProfile{
+		PersonalID:       entryLogInput.PersonalID,
+		Name:             entryLogInput.Name,
+		Phone:            entryLogInput.Phone,
+		Address:          entryLogInput.Address,
+		UpdatedTimestamp: entryLogInput.entryTimestamp,
+	}
+	err = updatePersonProfile(stub, enc, profiles, profile)
+	if err != nil {
+		return err
 	}
 
-	// ==== Create entryLog private details object with price, marshal to JSON, and save to state ====
+	// ==== Create entryLog private details object referencing the profile, marshal to JSON, and save to state ====
 	entryLogPrivateDetails := &entryLogPrivateDetails{
 		ObjectType: "entryLogPrivateDetails",
+		SchemaVersion: entryLogSchemaVersion,
 		EntryLogID: entryLogInput.EntryLogID,
 		PersonalID: entryLogInput.PersonalID,
 		FacilityID: entryLogInput.FacilityID,
-		Name:		entryLogInput.Name,
-		Phone:		entryLogInput.Phone,
-		Address:	entryLogInput.Address,
 	}
 	entryLogPrivateDetailsBytes, err := json.Marshal(entryLogPrivateDetails)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
 	err = stub.PutPrivateData("collectionEntryLogPrivateDetails", entryLogInput.EntryLogID, entryLogPrivateDetailsBytes)
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
 
 	indexName := "facility~entryLog"
-	facilityEntryLogIndexKey, err := stub.CreateCompositeKey(indexName, []string{entryLogPrivateDetails.FacilityID, entryLogPrivateDetails.EntryLogID})
+	facilityEntryLogIndexKey, err := createIndexKey(stub, indexName, []string{entryLogPrivateDetails.FacilityID, entryLogPrivateDetails.EntryLogID})
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
 	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the plant.
 	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
@@ -233,65 +473,116 @@ func (t *SimpleChaincode) setEntryLog(stub shim.ChaincodeStubInterface, args []s
 	stub.PutPrivateData("collectionEntryLogPrivateDetails", facilityEntryLogIndexKey, value)
 
 	indexName = "personal~entryLog"
-	personalEntryLogIndexKey, err := stub.CreateCompositeKey(indexName, []string{entryLogPrivateDetails.PersonalID, entryLogPrivateDetails.EntryLogID})
+	personalEntryLogIndexKey, err := createIndexKey(stub, indexName, []string{entryLogPrivateDetails.PersonalID, entryLogPrivateDetails.EntryLogID})
 	if err != nil {
-		return shim.Error(err.Error())
+		return err
 	}
 	//  Save index entry to state. Only the key name is needed, no need to store a duplicate copy of the plant.
 	//  Note - passing a 'nil' value will effectively delete the key from state, therefore we pass null character as value
 	stub.PutPrivateData("collectionEntryLogPrivateDetails", personalEntryLogIndexKey, value)
 
-	// ==== entryLog saved and indexed. Return success ====
-	fmt.Println("- end init entryLog")
-	return shim.Success(nil)
+	// ==== The same index keys in collectionEntryLog page the public queries ====
+	err = putEntryLogIndexes(stub, entryLog)
+	if err != nil {
+		return err
+	}
+
+	// ==== Save the occupancy of the facility with the person counted in ====
+	if entryLogInput.countedIn {
+		_, err = putOccupancy(stub, occupancies[entryLog.FacilityID])
+		if err != nil {
+			return err
+		}
+	}
+
+	// ==== Save the read counter of the tag, taken by this entryLog ====
+	if entryLogInput.sun != nil {
+		err = putTagSUN(stub, entryLogInput.sun)
+		if err != nil {
+			return err
+		}
+	}
+
+	// ==== Mark the entryLog as open until recordExit checks the person out ====
+	return putOpenEntryLog(stub, entryLog)
 }
 
 // ===============================================
 // getEntryLog - read a entryLog from chaincode state
 // ===============================================
 func (t *SimpleChaincode) getEntryLog(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var entryLogID, jsonResp string
+	var entryLogID string
 	var err error
 
 	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting entryLogID of the entryLog to query")
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting entryLogID of the entryLog to query")
 	}
 
 	entryLogID = args[0]
 	valAsBytes, err := stub.GetPrivateData("collectionEntryLog", entryLogID) //get the entryLog from chaincode state
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + entryLogID + "\"}"
-		return shim.Error(jsonResp)
+		return errorResponse(errCodeLedgerError, "", "Failed to get state for %s: %s", entryLogID, err.Error())
 	} else if valAsBytes == nil {
-		jsonResp = "{\"Error\":\"entryLog does not exist: " + entryLogID + "\"}"
-		return shim.Error(jsonResp)
+		return errorResponse(errCodeNotFound, "entryLogID", "entryLog does not exist: %s", entryLogID)
 	}
 
-	return shim.Success(valAsBytes)
+	config, err := getConfig(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get config: %s", err.Error())
+	}
+
+	// older records are returned in the current schema
+	entry, _, err := readEntryLog(config, valAsBytes)
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+	entryLogJSONasBytes, err := json.Marshal(entry)
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+
+	return shim.Success(entryLogJSONasBytes)
 }
 
 // ===============================================
 // getEntryLoggetEntryLogPrivateDetails - read a entryLog private details from chaincode state
+// Transient: encryptionKey and encryptionKeyID, to decrypt name, phone and address
 // ===============================================
 func (t *SimpleChaincode) getEntryLogPrivateDetails(stub shim.ChaincodeStubInterface, args []string) pb.Response {
-	var entryLogID, jsonResp string
+	var entryLogID string
 	var err error
 
 	if len(args) != 1 {
-		return shim.Error("Incorrect number of arguments. Expecting entryLogID of the entryLog to query")
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting entryLogID of the entryLog to query")
 	}
 
 	entryLogID = args[0]
 	valAsBytes, err := stub.GetPrivateData("collectionEntryLogPrivateDetails", entryLogID) //get the entryLog private details from chaincode state
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get private details for " + entryLogID + ": " + err.Error() + "\"}"
-		return shim.Error(jsonResp)
+		return errorResponse(errCodeLedgerError, "", "Failed to get private details for %s: %s", entryLogID, err.Error())
 	} else if valAsBytes == nil {
-		jsonResp = "{\"Error\":\"entryLog private details does not exist: " + entryLogID + "\"}"
-		return shim.Error(jsonResp)
+		return errorResponse(errCodeNotFound, "entryLogID", "entryLog private details does not exist: %s", entryLogID)
 	}
 
-	return shim.Success(valAsBytes)
+	// older records are returned in the current schema
+	details, _, err := readEntryLogPrivateDetails(valAsBytes)
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+	enc, err := getEncryptionKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	err = joinPersonProfile(stub, enc, details, make(map[string]*personProfile))
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	detailsJSONasBytes, err := json.Marshal(details)
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+
+	return shim.Success(detailsJSONasBytes)
 }
 
 // ==================================================
@@ -305,36 +596,62 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 	}
 
 	if len(args) != 0 {
-		return shim.Error("Incorrect number of arguments. Private entryLogID must be passed in transient map.")
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Private entryLogID must be passed in transient map.")
 	}
 
 	transMap, err := stub.GetTransient()
 	if err != nil {
-		return shim.Error("Error getting transient: " + err.Error())
+		return errorResponse(errCodeLedgerError, "", "Error getting transient: %s", err.Error())
 	}
 
 	if _, ok := transMap["entryLog_delete"]; !ok {
-		return shim.Error("entryLog_delete must be a key in the transient map")
+		return errorResponse(errCodeRequired, "entryLog_delete", "entryLog_delete must be a key in the transient map")
 	}
 
 	if len(transMap["entryLog_delete"]) == 0 {
-		return shim.Error("entryLog_delete value in the transient map must be a non-empty JSON string")
+		return errorResponse(errCodeRequired, "entryLog_delete", "entryLog_delete value in the transient map must be a non-empty JSON string")
 	}
 
 	var entryLogDeleteInput entryLogDeleteTransientInput
-	err = json.Unmarshal(transMap["entryLog_delete"], &entryLogDeleteInput)
+	err = decodeStrict(transMap["entryLog_delete"], &entryLogDeleteInput)
 	if err != nil {
-		return shim.Error("Failed to decode JSON of: " + string(transMap["entryLog_delete"]))
+		return toErrorResponse(err)
 	}
 
-	if len(entryLogDeleteInput.EntryLogID) == 0 {
-		return shim.Error("entryLogID field must be a non-empty string")
+	err = validatePattern("entryLogID", entryLogDeleteInput.EntryLogID, entryLogIDPattern)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get config: %s", err.Error())
+	}
+
+	// an entryLog that was never checked out must not stay open, nor listed, after it is gone
+	entryLogAsBytes, err := stub.GetPrivateData("collectionEntryLog", entryLogDeleteInput.EntryLogID)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get entryLog: %s", err.Error())
+	} else if entryLogAsBytes != nil {
+		// the index keys of older records were written in the current schema
+		entryLogToDelete, _, err := readEntryLog(config, entryLogAsBytes)
+		if err != nil {
+			return errorResponse(errCodeInternal, "", "%s", err.Error())
+		}
+		err = delOpenEntryLog(stub, config, entryLogToDelete)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+		err = delEntryLogIndexes(stub, entryLogToDelete)
+		if err != nil {
+			return toErrorResponse(err)
+		}
 	}
 
 	// delete the entryLog from state
 	err = stub.DelPrivateData("collectionEntryLog", entryLogDeleteInput.EntryLogID)
 	if err != nil {
-		return shim.Error("Failed to delete state:" + err.Error())
+		return errorResponse(errCodeLedgerError, "", "Failed to delete state: %s", err.Error())
 	}
 
     // *******************************************************************************************************************************************
@@ -342,72 +659,123 @@ func (t *SimpleChaincode) delete(stub shim.ChaincodeStubInterface, args []string
 	// Finally, delete private details of entryLog
 	err = stub.DelPrivateData("collectionEntryLogPrivateDetails", entryLogDeleteInput.EntryLogID)
 	if err != nil {
-		return shim.Error(err.Error())
+		return toErrorResponse(err)
 	}
 
 	return shim.Success(nil)
 }
 
 // ===========================================================
-// transfer a entryLog by setting a new owner name on the entryLog
+// updateAddress - change the address in a person's profile, which every entryLog
+// of the person reads. The person is given by personalID or by one of their entryLogIDs.
+// Transient: encryptionKey and encryptionKeyID, the profile is re-encrypted with them
 // ===========================================================
 func (t *SimpleChaincode) updateAddress(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
-	fmt.Println("- start transfer entryLog")
+	fmt.Println("- start update address")
 
 	type entryLogTransferTransientInput struct {
-		EntryLogID  string `json:"entryLogID"`
+		EntryLogID  string `json:"entryLogID"`	// either entryLogID or personalID
+		PersonalID  string `json:"personalID"`
 		Address 	string `json:"address"`
 	}
 
 	if len(args) != 0 {
-		return shim.Error("Incorrect number of arguments. Private entryLog data must be passed in transient map.")
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Private entryLog data must be passed in transient map.")
 	}
 
 	transMap, err := stub.GetTransient()
 	if err != nil {
-		return shim.Error("Error getting transient: " + err.Error())
+		return errorResponse(errCodeLedgerError, "", "Error getting transient: %s", err.Error())
 	}
 
 	if _, ok := transMap["entryLog_address"]; !ok {
-		return shim.Error("entryLog_address must be a key in the transient map")
+		return errorResponse(errCodeRequired, "entryLog_address", "entryLog_address must be a key in the transient map")
 	}
 
 	if len(transMap["entryLog_address"]) == 0 {
-		return shim.Error("entryLog_address value in the transient map must be a non-empty JSON string")
+		return errorResponse(errCodeRequired, "entryLog_address", "entryLog_address value in the transient map must be a non-empty JSON string")
 	}
 
 	var entryLogTransferInput entryLogTransferTransientInput
-	err = json.Unmarshal(transMap["entryLog_address"], &entryLogTransferInput)
+	err = decodeStrict(transMap["entryLog_address"], &entryLogTransferInput)
 	if err != nil {
-		return shim.Error("Failed to decode JSON of: " + string(transMap["entryLog_address"]))
+		return toErrorResponse(err)
 	}
 
-	if len(entryLogTransferInput.EntryLogID) == 0 {
-		return shim.Error("entryLogID field must be a non-empty string")
+	err = validateText("address", entryLogTransferInput.Address, maxAddressLength)
+	if err != nil {
+		return toErrorResponse(err)
 	}
-	if len(entryLogTransferInput.Address) == 0 {
-		return shim.Error("address field must be a non-empty string")
+	enc, err := requireEncryptionKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
 	}
 
-	entryLogAsBytes, err := stub.GetPrivateData("collectionEntryLogPrivateDetails", entryLogTransferInput.EntryLogID)
-	if err != nil {
-		return shim.Error("Failed to get entryLog:" + err.Error())
-	} else if entryLogAsBytes == nil {
-		return shim.Error("entryLog does not exist: " + entryLogTransferInput.EntryLogID)
+	var profile *personProfile
+	if len(entryLogTransferInput.PersonalID) != 0 {
+		// a raw personalID needs the pseudonym key in the transient map
+		key, err := getPseudonymKey(stub)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+		personalIDs, err := personalIDAliases(key, "personalID", entryLogTransferInput.PersonalID)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+		profile, err = findPersonProfile(stub, personalIDs)
+		if err != nil {
+			return toErrorResponse(err)
+		} else if profile == nil {
+			return errorResponse(errCodeNotFound, "personalID", "person profile does not exist: %s", entryLogTransferInput.PersonalID)
+		}
+	} else {
+		err = validatePattern("entryLogID", entryLogTransferInput.EntryLogID, entryLogIDPattern)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+
+		entryLogAsBytes, err := stub.GetPrivateData("collectionEntryLogPrivateDetails", entryLogTransferInput.EntryLogID)
+		if err != nil {
+			return errorResponse(errCodeLedgerError, "", "Failed to get entryLog: %s", err.Error())
+		} else if entryLogAsBytes == nil {
+			return errorResponse(errCodeNotFound, "entryLogID", "entryLog does not exist: %s", entryLogTransferInput.EntryLogID)
+		}
+
+		details, _, err := readEntryLogPrivateDetails(entryLogAsBytes) //unmarshal it aka JSON.parse()
+		if err != nil {
+			return errorResponse(errCodeInternal, "", "%s", err.Error())
+		}
+		profile, err = readPersonProfile(stub, details.PersonalID)
+		if err != nil {
+			return toErrorResponse(err)
+		} else if profile == nil {
+			// an entryLog from before the profiles existed, its copy becomes the profile
+			profile = &personProfile{PersonalID: details.PersonalID, Name: details.Name, Phone: details.Phone}
+		}
 	}
 
-	entryLogToTransfer := entryLogPrivateDetails{}
-	err = json.Unmarshal(entryLogAsBytes, &entryLogToTransfer) //unmarshal it aka JSON.parse()
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	// the name and phone are kept, so they must be readable with the key passed
+	err = openPersonProfile(enc, profile)
 	if err != nil {
-		return shim.Error(err.Error())
+		return toErrorResponse(err)
+	} else if len(profile.Ciphertext) != 0 {
+		return errorResponse(errCodeConflict, encryptionKeyIDTransientKey, "person profile is encrypted with key %s", profile.KeyID)
 	}
-	entryLogToTransfer.Address = entryLogTransferInput.Address //change the owner
+	profile.Address = entryLogTransferInput.Address //change the address of every entryLog of the person
+	profile.UpdatedTimestamp = txTime.Unix()
 
-	entryLogJSONasBytes, _ := json.Marshal(entryLogToTransfer)
-	err = stub.PutPrivateData("collectionEntryLogPrivateDetails", entryLogToTransfer.EntryLogID, entryLogJSONasBytes) //rewrite the entryLog
+	err = sealPersonProfile(stub, enc, profile)
 	if err != nil {
-		return shim.Error(err.Error())
+		return toErrorResponse(err)
+	}
+	err = putPersonProfile(stub, profile)
+	if err != nil {
+		return toErrorResponse(err)
 	}
 
 	fmt.Println("- end updateAddress (success)")
@@ -416,6 +784,10 @@ func (t *SimpleChaincode) updateAddress(stub shim.ChaincodeStubInterface, args [
 
 // ===========================================================================================
 // queryEntryLogsByPersonalID performs a range query based on the start and end keys provided.
+// Args: personalID, pageSize (optional), bookmark (optional). With a pageSize one page
+// is read from the personal~entryLog index, see getEntryLogsByCompositeKey, without one
+// at most maxQueryLimit entryLogs are returned, see unpagedResponse. Persons may only
+// query their own, see assertPersonQueryCaller.
 
 // Read-only function results are not typically submitted to ordering. If the read-only
 // results are submitted to ordering, or if the query is used in an update transaction
@@ -428,16 +800,53 @@ func (t *SimpleChaincode) updateAddress(stub shim.ChaincodeStubInterface, args [
 func (t *SimpleChaincode) queryEntryLogsByPersonalID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 
 	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting 1")
 	}
 
-	personalID := args[0]
+	// a raw personalID needs the pseudonym key in the transient map
+	key, err := getPseudonymKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	err = assertPersonQueryCaller(stub, key, args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	personalIDs, err := personalIDAliases(key, "personalID", args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	}
 
-	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"entryLog\",\"personalID\":\"%s\"}}", personalID)
+	// ==== One page from the personal~entryLog index if a pageSize is given ====
+	pageSize, bookmark, err := parsePageArgs(args[1:])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	if pageSize != 0 {
+		results, err := getEntryLogsByCompositeKey(stub, personalIDs, personalEntryLogIndex, pageSize, bookmark)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+		return shim.Success(results)
+	}
 
-	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	// ==== Otherwise the first maxQueryLimit entryLogs, by the indexPersonalID index ====
+	queryAsBytes, err := json.Marshal(map[string]interface{}{
+		"selector": map[string]interface{}{"docType": "entryLog", "personalID": map[string]interface{}{"$in": personalIDs}},
+		"limit":    maxQueryLimit + 1,
+	})
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+	queryString := string(queryAsBytes)
+
+	queryResults, truncated, err := getQueryResultForQueryString(stub, queryString, maxQueryLimit)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	queryResults, err = unpagedResponse(queryResults, maxQueryLimit, truncated, "")
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
 	}
 	return shim.Success(queryResults)
 }
@@ -459,6 +868,10 @@ func (t *SimpleChaincode) queryEntryLogsByPersonalID(stub shim.ChaincodeStubInte
 // queryEntryLogsByFacilityID queries for entryLogs based on a passed in owner.
 // This is an example of a parameterized query where the query logic is baked into the chaincode,
 // and accepting a single query parameter (owner).
+// Args: facilityID, pageSize (optional), bookmark (optional). With a pageSize one page
+// is read from the facility~entryLog index instead of the state database, without one
+// at most maxQueryLimit entryLogs are returned, see unpagedResponse. Facility operators
+// may only query the facilities of their org, see assertFacilityQueryCaller.
 // Only available on state databases that support rich query (e.g. CouchDB)
 // =========================================================================================
 func (t *SimpleChaincode) queryEntryLogsByFacilityID(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -466,27 +879,55 @@ func (t *SimpleChaincode) queryEntryLogsByFacilityID(stub shim.ChaincodeStubInte
 	//   0
 	// "bob"
 	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting 1")
 	}
 
 	facilityID := args[0]
+	err := assertFacilityQueryCaller(stub, facilityID)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	// ==== One page from the facility~entryLog index if a pageSize is given ====
+	pageSize, bookmark, err := parsePageArgs(args[1:])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	if pageSize != 0 {
+		results, err := getEntryLogsByCompositeKey(stub, []string{facilityID}, facilityEntryLogIndex, pageSize, bookmark)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+		return shim.Success(results)
+	}
 
-	queryString := fmt.Sprintf("{\"selector\":{\"docType\":\"entryLog\",\"FacilityID\":\"%s\"}}", facilityID)
-	fmt.Println(queryString);
+	// ==== Otherwise the first maxQueryLimit entryLogs, by the indexFacilityID index ====
+	// records before schema version 3 store the field as FacilityID
+	queryAsBytes, err := json.Marshal(map[string]interface{}{
+		"selector": selectorWithLegacyFields(map[string]interface{}{"docType": "entryLog", "facilityID": facilityID}),
+		"limit":    maxQueryLimit + 1,
+	})
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+	queryString := string(queryAsBytes)
 
-	queryResults, err := getQueryResultForQueryString(stub, queryString)
-	fmt.Println(queryResults);
+	queryResults, truncated, err := getQueryResultForQueryString(stub, queryString, maxQueryLimit)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	queryResults, err = unpagedResponse(queryResults, maxQueryLimit, truncated, "")
 	if err != nil {
-		return shim.Error(err.Error())
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
 	}
 	return shim.Success(queryResults)
 }
 
 // ===== Example: Ad hoc rich query ========================================================
 // queryEntryLogs uses a query string to perform a query for entryLogs.
-// Query string matching state database syntax is passed in and executed as is.
+// The query is checked by parseEntryLogQuery before it runs: a flat selector on allowed
+// fields and operators that matches entryLogID, facilityID or personalID, and a limit.
 // Supports ad hoc queries that can be defined at runtime by the client.
-// If this is not desired, follow the queryEntryLogsForOwner example for parameterized queries.
 // Only available on state databases that support rich query (e.g. CouchDB)
 // =========================================================================================
 func (t *SimpleChaincode) queryEntryLogs(stub shim.ChaincodeStubInterface, args []string) pb.Response {
@@ -494,14 +935,18 @@ func (t *SimpleChaincode) queryEntryLogs(stub shim.ChaincodeStubInterface, args
 	//   0
 	// "queryString"
 	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting 1")
 	}
 
-	queryString := args[0]
+	// conditions on entryLogID or facilityID also match records stored before schema version 3
+	queryString, limit, err := parseEntryLogQuery(args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	}
 
-	queryResults, err := getQueryResultForQueryString(stub, queryString)
+	queryResults, _, err := getQueryResultForQueryString(stub, queryString, limit)
 	if err != nil {
-		return shim.Error(err.Error())
+		return toErrorResponse(err)
 	}
 	return shim.Success(queryResults)
 }
@@ -509,14 +954,19 @@ func (t *SimpleChaincode) queryEntryLogs(stub shim.ChaincodeStubInterface, args
 // =========================================================================================
 // getQueryResultForQueryString executes the passed in query string.
 // Result set is built and returned as a byte array containing the JSON results.
+// At most limit records are returned, all of them if limit is 0; the query should ask
+// for one more to report whether it was truncated at limit.
 // =========================================================================================
-func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string) ([]byte, error) {
+func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString string, limit int) ([]byte, bool, error) {
 
-	fmt.Printf("- getQueryResultForQueryString queryString:\n%s\n", queryString)
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, false, err
+	}
 
 	resultsIterator, err := stub.GetPrivateDataQueryResult("collectionEntryLog", queryString)
 	if err != nil {
-		return nil, err
+		return nil, false, err
 	}
 	defer resultsIterator.Close()
 
@@ -525,11 +975,22 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 	buffer.WriteString("[")
 
 	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
+	for count := 0; resultsIterator.HasNext() && (limit == 0 || count < limit); count++ {
 		res, err := resultsIterator.Next()
 		if err != nil {
-			return nil, err
+			return nil, false, err
+		}
+
+		// older records are returned in the current schema
+		entry, _, err := readEntryLog(config, res.Value)
+		if err != nil {
+			return nil, false, err
+		}
+		entryLogJSONasBytes, err := json.Marshal(entry)
+		if err != nil {
+			return nil, false, err
 		}
+
 		// Add a comma before array members, suppress it for the first array member
 		if bArrayMemberAlreadyWritten == true {
 			buffer.WriteString(",")
@@ -541,74 +1002,124 @@ func getQueryResultForQueryString(stub shim.ChaincodeStubInterface, queryString
 
 		buffer.WriteString(", \"Record\":")
 		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(res.Value))
+		buffer.WriteString(string(entryLogJSONasBytes))
 		buffer.WriteString("}")
 		bArrayMemberAlreadyWritten = true
 	}
 	buffer.WriteString("]")
 
-	fmt.Printf("- getQueryResultForQueryString queryResult:\n%s\n", buffer.String())
-
-	return buffer.Bytes(), nil
+	return buffer.Bytes(), limit != 0 && resultsIterator.HasNext(), nil
 }
 
+// ===========================================================================
+// getPrivateEntryLogByFacility - the private details of a facility's entryLogs.
+// Args: facilityID, pageSize (optional), bookmark (optional)
+// ===========================================================================
 func (t *SimpleChaincode) getPrivateEntryLogByFacility(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting 1")
 	}
 
 	facilityID := args[0]
 	indexKey := "facility~entryLog"
 
-	results, err := getEntryLogPrivateDetailsByCompositeKey(stub, facilityID, indexKey)
+	pageSize, bookmark, err := parsePageArgs(args[1:])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	results, err := getEntryLogPrivateDetailsByCompositeKey(stub, []string{facilityID}, indexKey, pageSize, bookmark)
 	if err != nil {
-		return shim.Error(err.Error())
+		return toErrorResponse(err)
 	}
 	return shim.Success(results)
 }
 
+// ===========================================================================
+// getPrivateEntryLogByPerson - the private details of a person's entryLogs.
+// Args: personalID, pageSize (optional), bookmark (optional)
+// ===========================================================================
 func (t *SimpleChaincode) getPrivateEntryLogByPerson(stub shim.ChaincodeStubInterface, args []string) pb.Response {
 	if len(args) < 1 {
-		return shim.Error("Incorrect number of arguments. Expecting 1")
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting 1")
 	}
 
-	personalID := args[0]
+	// a raw personalID needs the pseudonym key in the transient map
+	key, err := getPseudonymKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	personalIDs, err := personalIDAliases(key, "personalID", args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	}
 	indexKey := "personal~entryLog"
 
-	results, err := getEntryLogPrivateDetailsByCompositeKey(stub, personalID, indexKey)
+	pageSize, bookmark, err := parsePageArgs(args[1:])
 	if err != nil {
-		return shim.Error(err.Error())
+		return toErrorResponse(err)
+	}
+
+	results, err := getEntryLogPrivateDetailsByCompositeKey(stub, personalIDs, indexKey, pageSize, bookmark)
+	if err != nil {
+		return toErrorResponse(err)
 	}
 	return shim.Success(results)
 }
 
-func getEntryLogPrivateDetailsByCompositeKey(stub shim.ChaincodeStubInterface, key string, indexKey string) ([]byte, error) {
-	resultsIterator, err := stub.GetPrivateDataByPartialCompositeKey("collectionEntryLogPrivateDetails", indexKey, []string{key})
+// ===========================================================================
+// getEntryLogPrivateDetailsByCompositeKey - the private details listed under any of keys in the index,
+// their name, phone and address decrypted with the encryption key of the transient map, if any.
+// With a pageSize only the page after bookmark is returned, wrapped by pageResponse,
+// without one the first maxQueryLimit, see unpagedResponse.
+// ===========================================================================
+func getEntryLogPrivateDetailsByCompositeKey(stub shim.ChaincodeStubInterface, keys []string, indexKey string, pageSize int, bookmark string) ([]byte, error) {
+	enc, err := getEncryptionKey(stub)
+	if err != nil {
+		return nil, err
+	}
+	limit := pageSize
+	if limit == 0 {
+		limit = maxQueryLimit
+	}
+	entryLogIDs, nextBookmark, err := getIndexPage(stub, "collectionEntryLogPrivateDetails", indexKey, keys, limit, bookmark)
 	if err != nil {
 		return nil, err
 	}
-	defer resultsIterator.Close()
 
 	// buffer is a JSON array containing QueryRecords
 	var buffer bytes.Buffer
 	buffer.WriteString("[")
 
-	bArrayMemberAlreadyWritten := false
-	for resultsIterator.HasNext() {
-		res, err := resultsIterator.Next()
+	// a person's profile is read once for all of their entries
+	profiles := make(map[string]*personProfile)
+
+	fetched := 0
+	for _, returnedID := range entryLogIDs {
+		valAsBytes, err := stub.GetPrivateData("collectionEntryLogPrivateDetails", returnedID) //get the entryLog private details from chaincode state
 		if err != nil {
 			return nil, err
+		} else if valAsBytes == nil {
+			// the index entry outlived its record
+			continue
 		}
 
-		_, compositeKeyParts, err := stub.SplitCompositeKey(res.Key)
+		// older records are returned in the current schema
+		details, _, err := readEntryLogPrivateDetails(valAsBytes)
+		if err != nil {
+			return nil, err
+		}
+		err = joinPersonProfile(stub, enc, details, profiles)
+		if err != nil {
+			return nil, err
+		}
+		detailsJSONasBytes, err := json.Marshal(details)
 		if err != nil {
 			return nil, err
 		}
-
-		returnedID := compositeKeyParts[1]
 
 		// Add a comma before array members, suppress it for the first array member
-		if bArrayMemberAlreadyWritten == true {
+		if fetched > 0 {
 			buffer.WriteString(",")
 		}
 		buffer.WriteString("{\"Key\":")
@@ -616,21 +1127,17 @@ func getEntryLogPrivateDetailsByCompositeKey(stub shim.ChaincodeStubInterface, k
 		buffer.WriteString(returnedID)
 		buffer.WriteString("\"")
 
-		valAsBytes, err := stub.GetPrivateData("collectionEntryLogPrivateDetails", returnedID) //get the entryLog private details from chaincode state
-		if err != nil {
-			return nil, err
-		}
-
 		buffer.WriteString(", \"Record\":")
 		// Record is a JSON object, so we write as-is
-		buffer.WriteString(string(valAsBytes))
+		buffer.WriteString(string(detailsJSONasBytes))
 		buffer.WriteString("}")
-		bArrayMemberAlreadyWritten = true
+		fetched++
 	}
 	buffer.WriteString("]")
 
-	fmt.Printf("- Result:\n%s\n", buffer.String())
-
-	return buffer.Bytes(), nil
+	if pageSize == 0 {
+		return unpagedResponse(buffer.Bytes(), fetched, len(nextBookmark) != 0, nextBookmark)
+	}
+	return pageResponse(buffer.Bytes(), fetched, nextBookmark)
 }
 
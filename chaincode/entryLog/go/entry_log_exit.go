@@ -0,0 +1,261 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// openEntryLogIndex keys the entryLog a person currently has open at a facility.
+// Only one entryLog per person and facility can be open; a new entry replaces the marker.
+const openEntryLogIndex = "open~entryLog"
+
+type openEntryLog struct {
+	EntryLogID     string `json:"entryLogID"`
+	EntryTime      string `json:"entryTime"`
+	EntryTimestamp int64  `json:"entryTimestamp,omitempty"`
+}
+
+// ===========================================================================
+// putOpenEntryLog - mark entryLog as the open entry of its person and facility
+// ===========================================================================
+func putOpenEntryLog(stub shim.ChaincodeStubInterface, entry *entryLog) error {
+	openEntryLogKey, err := stub.CreateCompositeKey(openEntryLogIndex, []string{entry.FacilityID, entry.PersonalID})
+	if err != nil {
+		return err
+	}
+
+	openEntryLogAsBytes, err := json.Marshal(&openEntryLog{
+		EntryLogID:     entry.EntryLogID,
+		EntryTime:      entry.EntryTime,
+		EntryTimestamp: entry.EntryTimestamp,
+	})
+	if err != nil {
+		return err
+	}
+
+	return stub.PutPrivateData("collectionEntryLog", openEntryLogKey, openEntryLogAsBytes)
+}
+
+// ===========================================================================
+// delOpenEntryLog - remove the open marker, if it still points to entryLog,
+// and count the person out of the facility
+// ===========================================================================
+func delOpenEntryLog(stub shim.ChaincodeStubInterface, config *chaincodeConfig, entry *entryLog) error {
+	open, openEntryLogKey, err := getOpenEntryLog(stub, entry.FacilityID, entry.PersonalID)
+	if err != nil {
+		return err
+	}
+	if open == nil || open.EntryLogID != entry.EntryLogID {
+		return nil
+	}
+
+	err = stub.DelPrivateData("collectionEntryLog", openEntryLogKey)
+	if err != nil {
+		return err
+	}
+	return countExit(stub, config, entry.FacilityID, entry.ExitTimestamp)
+}
+
+// ===========================================================================
+// getOpenEntryLog - read the open marker of a person at a facility, nil if none
+// ===========================================================================
+func getOpenEntryLog(stub shim.ChaincodeStubInterface, facilityID string, personalID string) (*openEntryLog, string, error) {
+	openEntryLogKey, err := stub.CreateCompositeKey(openEntryLogIndex, []string{facilityID, personalID})
+	if err != nil {
+		return nil, "", err
+	}
+
+	openEntryLogAsBytes, err := stub.GetPrivateData("collectionEntryLog", openEntryLogKey)
+	if err != nil {
+		return nil, "", err
+	} else if openEntryLogAsBytes == nil {
+		return nil, openEntryLogKey, nil
+	}
+
+	open := &openEntryLog{}
+	err = json.Unmarshal(openEntryLogAsBytes, open)
+	if err != nil {
+		return nil, "", err
+	}
+	return open, openEntryLogKey, nil
+}
+
+// ===========================================================================
+// recordExit - check a person out of their open entryLog and store the dwell time.
+// The submitter must be a reader of the entryLog's facility, see getReader.
+// ===========================================================================
+func (t *SimpleChaincode) recordExit(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start record exit")
+
+	type entryLogExitTransientInput struct {
+		EntryLogID string `json:"entryLogID"` // optional, otherwise the open entryLog of personalID at facilityID
+		FacilityID string `json:"facilityID"`
+		PersonalID string `json:"personalID"`
+		ExitTime   string `json:"exitTime"`
+	}
+
+	if len(args) != 0 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Private exit data must be passed in transient map.")
+	}
+
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Error getting transient: %s", err.Error())
+	}
+
+	if _, ok := transMap["entryLog_exit"]; !ok {
+		return errorResponse(errCodeRequired, "entryLog_exit", "entryLog_exit must be a key in the transient map")
+	}
+
+	if len(transMap["entryLog_exit"]) == 0 {
+		return errorResponse(errCodeRequired, "entryLog_exit", "entryLog_exit value in the transient map must be a non-empty JSON string")
+	}
+
+	var exitInput entryLogExitTransientInput
+	err = decodeStrict(transMap["entryLog_exit"], &exitInput)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get config: %s", err.Error())
+	}
+	reader, err := getReader(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	err = validateRequired("exitTime", exitInput.ExitTime)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	exitTimestamp, exitTimeFlagged, err := checkEntryTime(stub, config, "exitTime", exitInput.ExitTime)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	// ==== Find the IDs the person's records can be stored under ====
+	var personalIDs []string
+	if len(exitInput.PersonalID) != 0 {
+		// a raw personalID needs the pseudonym key in the transient map
+		key, err := getPseudonymKey(stub)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+		personalIDs, err = personalIDAliases(key, "personalID", exitInput.PersonalID)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+	}
+
+	// ==== Find the entryLog to close ====
+	entryLogID := exitInput.EntryLogID
+	if len(entryLogID) != 0 {
+		err = validatePattern("entryLogID", entryLogID, entryLogIDPattern)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+	} else {
+		err = validatePattern("facilityID", exitInput.FacilityID, facilityIDPattern)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+		if len(personalIDs) == 0 {
+			return errorResponse(errCodeRequired, "personalID", "personalID field must be a non-empty string")
+		}
+
+		var open *openEntryLog
+		for _, personalID := range personalIDs {
+			open, _, err = getOpenEntryLog(stub, exitInput.FacilityID, personalID)
+			if err != nil {
+				return errorResponse(errCodeLedgerError, "", "Failed to get open entryLog: %s", err.Error())
+			} else if open != nil {
+				break
+			}
+		}
+		if open == nil {
+			return errorResponse(errCodeNotFound, "personalID", "No open entryLog for %s at %s", exitInput.PersonalID, exitInput.FacilityID)
+		}
+		entryLogID = open.EntryLogID
+	}
+
+	entryLogAsBytes, err := stub.GetPrivateData("collectionEntryLog", entryLogID)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get entryLog: %s", err.Error())
+	} else if entryLogAsBytes == nil {
+		return errorResponse(errCodeNotFound, "entryLogID", "entryLog does not exist: %s", entryLogID)
+	}
+
+	entryLogToClose, _, err := readEntryLog(config, entryLogAsBytes)
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+	err = assertReaderFacility(reader, entryLogToClose.FacilityID)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	if len(exitInput.FacilityID) != 0 && exitInput.FacilityID != entryLogToClose.FacilityID {
+		return errorResponse(errCodeConflict, "facilityID", "entryLog %s was not recorded at %s", entryLogID, exitInput.FacilityID)
+	}
+	if len(personalIDs) != 0 && !containsString(personalIDs, entryLogToClose.PersonalID) {
+		return errorResponse(errCodeConflict, "personalID", "entryLog %s does not belong to %s", entryLogID, exitInput.PersonalID)
+	}
+	if len(entryLogToClose.ExitTime) != 0 {
+		return errorResponse(errCodeConflict, "entryLogID", "entryLog already has an exit: %s", entryLogID)
+	}
+
+	// ==== Compute the dwell time ====
+	entryTimestamp := entryLogToClose.EntryTimestamp
+	if entryTimestamp == 0 {
+		entryTime, err := parseEntryTime(config, entryLogToClose.EntryTime)
+		if err != nil {
+			return errorResponse(errCodeInternal, "", "entryTime of %s %s", entryLogID, err.Error())
+		}
+		entryTimestamp = entryTime.Unix()
+	}
+	if exitTimestamp < entryTimestamp {
+		return errorResponse(errCodeOutOfRange, "exitTime", "exitTime must not be before entryTime %s", entryLogToClose.EntryTime)
+	}
+
+	entryLogToClose.ExitTime = exitInput.ExitTime
+	entryLogToClose.ExitTimestamp = exitTimestamp
+	entryLogToClose.ExitTimeFlagged = exitTimeFlagged
+	entryLogToClose.DwellSeconds = exitTimestamp - entryTimestamp
+
+	entryLogJSONasBytes, err := json.Marshal(entryLogToClose)
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+	err = stub.PutPrivateData("collectionEntryLog", entryLogID, entryLogJSONasBytes)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	err = delOpenEntryLog(stub, config, entryLogToClose)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	fmt.Println("- end record exit (success)")
+	return shim.Success(entryLogJSONasBytes)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
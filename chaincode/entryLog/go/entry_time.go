@@ -0,0 +1,79 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// entryTimeLayout is the format the apps use for entryTime and exitTime.
+// Such strings carry no zone and are read at the configured UTC offset.
+// RFC 3339 strings with an explicit zone are accepted as well.
+const entryTimeLayout = "2006-01-02 15:04:05"
+
+// ===========================================================================
+// parseEntryTime - parse an entryTime or exitTime display string
+// ===========================================================================
+func parseEntryTime(config *chaincodeConfig, value string) (time.Time, error) {
+	location := time.FixedZone("", config.EntryTimeOffsetMinutes*60)
+
+	parsed, err := time.ParseInLocation(entryTimeLayout, value, location)
+	if err == nil {
+		return parsed, nil
+	}
+	parsed, err = time.Parse(time.RFC3339, value)
+	if err == nil {
+		return parsed, nil
+	}
+	return time.Time{}, fmt.Errorf("must be formatted as %q or RFC 3339", entryTimeLayout)
+}
+
+// ===========================================================================
+// getTxTime - the client timestamp of the proposal, same on every endorser
+// ===========================================================================
+func getTxTime(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	txTimestamp, err := stub.GetTxTimestamp()
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Unix(txTimestamp.Seconds, int64(txTimestamp.Nanos)).UTC(), nil
+}
+
+// ===========================================================================
+// checkEntryTime - parse value and compare it with the transaction time.
+// Returns the UTC epoch seconds and whether the value had to be flagged;
+// under the reject policy a value outside the tolerance is an error instead.
+// ===========================================================================
+func checkEntryTime(stub shim.ChaincodeStubInterface, config *chaincodeConfig, field string, value string) (int64, bool, error) {
+	parsed, err := parseEntryTime(config, value)
+	if err != nil {
+		return 0, false, newError(errCodeInvalidFormat, field, "%s field %s", field, err.Error())
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return 0, false, err
+	}
+
+	skew := parsed.Sub(txTime)
+	if skew < 0 {
+		skew = -skew
+	}
+	if skew <= time.Duration(config.EntryTimeSkewSeconds)*time.Second {
+		return parsed.Unix(), false, nil
+	}
+
+	if config.EntryTimeSkewPolicy == skewPolicyReject {
+		return 0, false, newError(errCodeOutOfRange, field, "%s field %s is %s away from the transaction time %s, more than the allowed %ds",
+			field, value, skew.Round(time.Second), txTime.Format(time.RFC3339), config.EntryTimeSkewSeconds)
+	}
+	fmt.Printf("- %s %s flagged, %s away from the transaction time\n", field, value, skew.Round(time.Second))
+	return parsed.Unix(), true, nil
+}
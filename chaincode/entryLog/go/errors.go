@@ -0,0 +1,88 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Every function in Invoke fails with a chaincodeError as the response message:
+//
+//	{"code":"NOT_FOUND","field":"entryLogID","message":"entryLog does not exist: EntryLog1"}
+//
+// code is one of the stable codes below, field names the offending argument,
+// transient key or JSON field when there is one. The HTTP status each code maps to
+// in the apps is given in brackets.
+const (
+	// errCodeInvalidArgument - wrong number or form of arguments (400)
+	errCodeInvalidArgument = "INVALID_ARGUMENT"
+	// errCodeInvalidJSON - a transient value or argument is not the expected JSON (400)
+	errCodeInvalidJSON = "INVALID_JSON"
+	// errCodeUnknownField - the JSON has a field the function does not know (400)
+	errCodeUnknownField = "UNKNOWN_FIELD"
+	// errCodeRequired - a mandatory argument, transient key or field is missing or empty (400)
+	errCodeRequired = "REQUIRED"
+	// errCodeInvalidFormat - a field does not match its expected format (400)
+	errCodeInvalidFormat = "INVALID_FORMAT"
+	// errCodeOutOfRange - a field is well formed but outside its allowed values (400)
+	errCodeOutOfRange = "OUT_OF_RANGE"
+	// errCodeUnknownFunction - Invoke was called with a function it does not have (400)
+	errCodeUnknownFunction = "UNKNOWN_FUNCTION"
+	// errCodePermissionDenied - the client identity may not call the function (403)
+	errCodePermissionDenied = "PERMISSION_DENIED"
+	// errCodeNotFound - the record asked for is not stored (404)
+	errCodeNotFound = "NOT_FOUND"
+	// errCodeAlreadyExists - the record to create is already stored (409)
+	errCodeAlreadyExists = "ALREADY_EXISTS"
+	// errCodeConflict - the stored record is not in a state that allows the change (409)
+	errCodeConflict = "CONFLICT"
+	// errCodeResourceExhausted - a limit is reached, an org's privacy budget or a facility's capacity (429)
+	errCodeResourceExhausted = "RESOURCE_EXHAUSTED"
+	// errCodeLedgerError - reading or writing the ledger failed, the call may be retried (503)
+	errCodeLedgerError = "LEDGER_ERROR"
+	// errCodeInternal - a stored record could not be decoded or encoded (500)
+	errCodeInternal = "INTERNAL"
+)
+
+// chaincodeError is a machine-readable error. Its Error() is the JSON
+// returned to the client as the message of the error response.
+type chaincodeError struct {
+	Code    string `json:"code"`
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+func (e *chaincodeError) Error() string {
+	errorAsBytes, _ := json.Marshal(e)
+	return string(errorAsBytes)
+}
+
+func newError(code string, field string, format string, a ...interface{}) *chaincodeError {
+	return &chaincodeError{Code: code, Field: field, Message: fmt.Sprintf(format, a...)}
+}
+
+// ===========================================================================
+// errorResponse - fail the invocation with a chaincodeError
+// ===========================================================================
+func errorResponse(code string, field string, format string, a ...interface{}) pb.Response {
+	return shim.Error(newError(code, field, format, a...).Error())
+}
+
+// ===========================================================================
+// toErrorResponse - fail the invocation with err; errors that are not a
+// chaincodeError come from the stub and are reported as ledger failures
+// ===========================================================================
+func toErrorResponse(err error) pb.Response {
+	if ccErr, ok := err.(*chaincodeError); ok {
+		return shim.Error(ccErr.Error())
+	}
+	return errorResponse(errCodeLedgerError, "", "%s", err.Error())
+}
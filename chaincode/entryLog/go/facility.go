@@ -0,0 +1,354 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Facilities are kept in the channel's world state, not in a private collection,
+// so every org can look them up. The key is CreateCompositeKey(facilityObjectType, facilityID),
+// stored as "\x00facility\x00<facilityID>\x00", which listFacilities reads by the partial key.
+const facilityObjectType = "facility"
+
+const (
+	facilityStatusActive   = "active"
+	facilityStatusInactive = "inactive"
+)
+
+const (
+	maxFacilityNameLength = 100
+	maxFacilityTypeLength = 50
+)
+
+type facility struct {
+	ObjectType string `json:"docType"`
+	FacilityID string `json:"facilityID"`
+	Name       string `json:"name"`
+	Address    string `json:"address"`
+	Type       string `json:"type"`     // restaurant, cafe, gym, ...
+	Capacity   int    `json:"capacity"` // persons allowed inside at once, 0 if not limited
+	OwnerOrg   string `json:"ownerOrg"` // MSP ID of the org that registered the facility
+	Status     string `json:"status"`   // active or inactive
+
+	SUNRequired bool `json:"sunRequired,omitempty"` // entryLogs need a verified SUN read of one of its tags
+}
+
+// ===========================================================================
+// registerFacility - add a facility to the registry, owned by the caller's org.
+// Args: facility JSON {facilityID, name, address, type, capacity, status, sunRequired}
+// ===========================================================================
+func (t *SimpleChaincode) registerFacility(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start register facility")
+
+	type facilityInput struct {
+		FacilityID string `json:"facilityID"`
+		Name       string `json:"name"`
+		Address    string `json:"address"`
+		Type       string `json:"type"`
+		Capacity   int    `json:"capacity"`
+		Status     string `json:"status"` // optional, active by default
+
+		SUNRequired bool `json:"sunRequired"` // optional, false by default
+	}
+
+	if len(args) != 1 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting the facility JSON")
+	}
+
+	var input facilityInput
+	err := decodeStrict([]byte(args[0]), &input)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	if len(input.Status) == 0 {
+		input.Status = facilityStatusActive
+	}
+
+	ownerOrg, err := cid.GetMSPID(stub)
+	if err != nil {
+		return errorResponse(errCodePermissionDenied, "", "Failed to get the MSP ID of the caller: %s", err.Error())
+	}
+
+	newFacility := &facility{
+		ObjectType: facilityObjectType,
+		FacilityID: input.FacilityID,
+		Name:       input.Name,
+		Address:    input.Address,
+		Type:       input.Type,
+		Capacity:   input.Capacity,
+		OwnerOrg:   ownerOrg,
+		Status:     input.Status,
+
+		SUNRequired: input.SUNRequired,
+	}
+	err = validateFacility(newFacility)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	existing, err := readFacility(stub, newFacility.FacilityID)
+	if err != nil {
+		return toErrorResponse(err)
+	} else if existing != nil {
+		return errorResponse(errCodeAlreadyExists, "facilityID", "This facility already exists: %s", newFacility.FacilityID)
+	}
+
+	facilityAsBytes, err := putFacility(stub, newFacility)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	fmt.Println("- end register facility (success)")
+	return shim.Success(facilityAsBytes)
+}
+
+// ===========================================================================
+// updateFacility - change a registered facility, only the owning org may do so.
+// Args: facility JSON {facilityID, name, address, type, capacity, status, sunRequired};
+// fields left out keep their value.
+// ===========================================================================
+func (t *SimpleChaincode) updateFacility(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start update facility")
+
+	type facilityUpdateInput struct {
+		FacilityID string `json:"facilityID"`
+		Name       string `json:"name"`
+		Address    string `json:"address"`
+		Type       string `json:"type"`
+		Capacity   *int   `json:"capacity"`
+		Status     string `json:"status"`
+
+		SUNRequired *bool `json:"sunRequired"`
+	}
+
+	if len(args) != 1 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting the facility JSON")
+	}
+
+	var input facilityUpdateInput
+	err := decodeStrict([]byte(args[0]), &input)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	err = validatePattern("facilityID", input.FacilityID, facilityIDPattern)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	facilityToUpdate, err := readFacility(stub, input.FacilityID)
+	if err != nil {
+		return toErrorResponse(err)
+	} else if facilityToUpdate == nil {
+		return errorResponse(errCodeNotFound, "facilityID", "facility does not exist: %s", input.FacilityID)
+	}
+
+	callerOrg, err := cid.GetMSPID(stub)
+	if err != nil {
+		return errorResponse(errCodePermissionDenied, "", "Failed to get the MSP ID of the caller: %s", err.Error())
+	}
+	if callerOrg != facilityToUpdate.OwnerOrg {
+		return errorResponse(errCodePermissionDenied, "facilityID", "facility %s is owned by %s", facilityToUpdate.FacilityID, facilityToUpdate.OwnerOrg)
+	}
+
+	if len(input.Name) != 0 {
+		facilityToUpdate.Name = input.Name
+	}
+	if len(input.Address) != 0 {
+		facilityToUpdate.Address = input.Address
+	}
+	if len(input.Type) != 0 {
+		facilityToUpdate.Type = input.Type
+	}
+	if input.Capacity != nil {
+		facilityToUpdate.Capacity = *input.Capacity
+	}
+	if len(input.Status) != 0 {
+		facilityToUpdate.Status = input.Status
+	}
+	if input.SUNRequired != nil {
+		facilityToUpdate.SUNRequired = *input.SUNRequired
+	}
+	err = validateFacility(facilityToUpdate)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	facilityAsBytes, err := putFacility(stub, facilityToUpdate)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	fmt.Println("- end update facility (success)")
+	return shim.Success(facilityAsBytes)
+}
+
+// ===========================================================================
+// getFacility - read one facility from the registry. Args: facilityID
+// ===========================================================================
+func (t *SimpleChaincode) getFacility(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting facilityID of the facility to query")
+	}
+
+	facilityAsBytes, err := getFacilityAsBytes(stub, args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	} else if facilityAsBytes == nil {
+		return errorResponse(errCodeNotFound, "facilityID", "facility does not exist: %s", args[0])
+	}
+
+	return shim.Success(facilityAsBytes)
+}
+
+// ===========================================================================
+// listFacilities - every registered facility, optionally only those with a status.
+// Args: status (optional)
+// ===========================================================================
+func (t *SimpleChaincode) listFacilities(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting an optional status")
+	}
+	status := ""
+	if len(args) == 1 {
+		status = args[0]
+	}
+	if len(status) != 0 && status != facilityStatusActive && status != facilityStatusInactive {
+		return errorResponse(errCodeOutOfRange, "status", "status must be %s or %s", facilityStatusActive, facilityStatusInactive)
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(facilityObjectType, []string{})
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		res, err := resultsIterator.Next()
+		if err != nil {
+			return toErrorResponse(err)
+		}
+
+		if len(status) != 0 {
+			registered := facility{}
+			err = json.Unmarshal(res.Value, &registered)
+			if err != nil {
+				return errorResponse(errCodeInternal, "", "%s", err.Error())
+			}
+			if registered.Status != status {
+				continue
+			}
+		}
+
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(res.Value)
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	return shim.Success(buffer.Bytes())
+}
+
+// ===========================================================================
+// validateFacility - apply the registry rules to every field of a facility
+// ===========================================================================
+func validateFacility(f *facility) error {
+	validations := []error{
+		validatePattern("facilityID", f.FacilityID, facilityIDPattern),
+		validateText("name", f.Name, maxFacilityNameLength),
+		validateText("address", f.Address, maxAddressLength),
+		validateText("type", f.Type, maxFacilityTypeLength),
+	}
+	for _, err := range validations {
+		if err != nil {
+			return err
+		}
+	}
+	if f.Capacity < 0 {
+		return newError(errCodeOutOfRange, "capacity", "capacity field must not be negative")
+	}
+	if f.Status != facilityStatusActive && f.Status != facilityStatusInactive {
+		return newError(errCodeOutOfRange, "status", "status field must be %s or %s", facilityStatusActive, facilityStatusInactive)
+	}
+	return nil
+}
+
+// ===========================================================================
+// checkFacilityActive - the facility an entryLog is recorded at must be registered and active,
+// it is returned
+// ===========================================================================
+func checkFacilityActive(stub shim.ChaincodeStubInterface, facilityID string) (*facility, error) {
+	registered, err := readFacility(stub, facilityID)
+	if err != nil {
+		return nil, err
+	} else if registered == nil {
+		return nil, newError(errCodeNotFound, "facilityID", "facility is not registered: %s", facilityID)
+	}
+	if registered.Status != facilityStatusActive {
+		return nil, newError(errCodeConflict, "facilityID", "facility is %s: %s", registered.Status, facilityID)
+	}
+	return registered, nil
+}
+
+// ===========================================================================
+// readFacility - read and decode a facility, nil if it is not registered
+// ===========================================================================
+func readFacility(stub shim.ChaincodeStubInterface, facilityID string) (*facility, error) {
+	facilityAsBytes, err := getFacilityAsBytes(stub, facilityID)
+	if err != nil {
+		return nil, err
+	} else if facilityAsBytes == nil {
+		return nil, nil
+	}
+
+	registered := &facility{}
+	err = json.Unmarshal(facilityAsBytes, registered)
+	if err != nil {
+		return nil, err
+	}
+	return registered, nil
+}
+
+func getFacilityAsBytes(stub shim.ChaincodeStubInterface, facilityID string) ([]byte, error) {
+	facilityKey, err := stub.CreateCompositeKey(facilityObjectType, []string{facilityID})
+	if err != nil {
+		return nil, err
+	}
+	return stub.GetState(facilityKey)
+}
+
+// ===========================================================================
+// putFacility - save a facility to world state, return the stored JSON
+// ===========================================================================
+func putFacility(stub shim.ChaincodeStubInterface, f *facility) ([]byte, error) {
+	facilityKey, err := stub.CreateCompositeKey(facilityObjectType, []string{f.FacilityID})
+	if err != nil {
+		return nil, err
+	}
+
+	facilityAsBytes, err := json.Marshal(f)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(facilityKey, facilityAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return facilityAsBytes, nil
+}
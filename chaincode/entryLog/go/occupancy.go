@@ -0,0 +1,318 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The occupancy of a facility is the number of persons inside. It is only tracked while
+// the capacityPolicy is not off. Every transaction that changes it writes its own delta to
+// collectionEntryLog under occupancy~<facilityID>~<txID> and readers sum the deltas. The
+// sum is read by a range over the facility's deltas, which the committing peers check for
+// phantoms, so two transactions counting at the same facility in one block still conflict
+// and one of them has to be resubmitted; the deltas only keep them from rewriting one key.
+// Once a transaction reads maxOccupancyDeltas deltas it folds them into its own, so the
+// range stays short.
+//
+// An entry counts the person in unless they already have an open entryLog there;
+// recordExit, or deleting the open entryLog, counts them out. Persons who leave without
+// an exit stay counted, so the facility's operators can correct the count with
+// setOccupancy, at closing time for instance, which folds the deltas as well.
+const occupancyObjectType = "occupancy"
+
+// maxOccupancyDeltas is the number of deltas at which a transaction folds them
+const maxOccupancyDeltas = 20
+
+// facilityOccupancy is the sum of the deltas of a facility
+type facilityOccupancy struct {
+	FacilityID       string
+	Occupancy        int
+	UpdatedTimestamp int64
+
+	delta   int             // change made by the transaction
+	keys    []string        // delta keys summed
+	folded  bool            // the delta keys were deleted, the transaction writes the sum
+	entered map[string]bool // personalIDs counted in earlier in the transaction
+}
+
+// occupancyDelta is the change one transaction made to the occupancy of a facility.
+// Records written before deltas, under occupancy~<facilityID>, hold the whole count
+// in the same field and are summed alike.
+type occupancyDelta struct {
+	ObjectType       string `json:"docType"`
+	FacilityID       string `json:"facilityID"`
+	Occupancy        int    `json:"occupancy"`
+	UpdatedTimestamp int64  `json:"updatedTimestamp,omitempty"`
+}
+
+// ===========================================================================
+// getOccupancy - the persons currently inside a facility and its capacity. Args: facilityID
+// ===========================================================================
+func (t *SimpleChaincode) getOccupancy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting facilityID")
+	}
+	facilityID := args[0]
+	err := validatePattern("facilityID", facilityID, facilityIDPattern)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get config: %s", err.Error())
+	}
+	if config.CapacityPolicy == capacityPolicyOff {
+		return errorResponse(errCodeConflict, "", "occupancy is not tracked while the capacityPolicy is %s", capacityPolicyOff)
+	}
+	registered, err := readFacility(stub, facilityID)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get facility: %s", err.Error())
+	} else if registered == nil {
+		return errorResponse(errCodeNotFound, "facilityID", "facility is not registered: %s", facilityID)
+	}
+	occupancy, err := readOccupancy(stub, nil, facilityID)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get occupancy: %s", err.Error())
+	}
+
+	resultAsBytes, err := json.Marshal(map[string]interface{}{
+		"facilityID":       facilityID,
+		"occupancy":        occupancy.Occupancy,
+		"capacity":         registered.Capacity,
+		"full":             registered.Capacity > 0 && occupancy.Occupancy >= registered.Capacity,
+		"updatedTimestamp": occupancy.UpdatedTimestamp,
+	})
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+	return shim.Success(resultAsBytes)
+}
+
+// ===========================================================================
+// setOccupancy - correct the occupancy of a facility of the caller's org. The deltas
+// summed so far are replaced by one holding the new count.
+// Args: facilityID, occupancy
+// ===========================================================================
+func (t *SimpleChaincode) setOccupancy(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start set occupancy")
+
+	if len(args) != 2 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting facilityID and occupancy")
+	}
+	facilityID := args[0]
+	err := validatePattern("facilityID", facilityID, facilityIDPattern)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	count, err := strconv.Atoi(args[1])
+	if err != nil || count < 0 {
+		return errorResponse(errCodeOutOfRange, "occupancy", "occupancy must be a number not below 0")
+	}
+	err = assertFacilityOwner(stub, facilityID)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get config: %s", err.Error())
+	}
+	if config.CapacityPolicy == capacityPolicyOff {
+		return errorResponse(errCodeConflict, "", "occupancy is not tracked while the capacityPolicy is %s", capacityPolicyOff)
+	}
+	occupancy, err := readOccupancy(stub, nil, facilityID)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get occupancy: %s", err.Error())
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get transaction time: %s", err.Error())
+	}
+
+	err = foldOccupancy(stub, occupancy)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to fold occupancy: %s", err.Error())
+	}
+	occupancy.Occupancy = count
+	occupancy.UpdatedTimestamp = txTime.Unix()
+	occupancyAsBytes, err := putOccupancy(stub, occupancy)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to put occupancy: %s", err.Error())
+	}
+
+	fmt.Println("- end set occupancy (success)")
+	return shim.Success(occupancyAsBytes)
+}
+
+// ===========================================================================
+// checkCapacity - count the person of a new entryLog in at its facility, unless they are
+// already inside, and flag the entryLog if the facility is full. Under the reject policy
+// a full facility is an error; under the off policy nothing is counted. occupancies holds
+// the occupancies counted earlier in the transaction, by facilityID; putEntryLog writes them.
+// ===========================================================================
+func checkCapacity(stub shim.ChaincodeStubInterface, config *chaincodeConfig, occupancies map[string]*facilityOccupancy, entryLogInput *entryLogTransientInput) error {
+	if config.CapacityPolicy == capacityPolicyOff {
+		return nil
+	}
+	occupancy, err := readOccupancy(stub, occupancies, entryLogInput.FacilityID)
+	if err != nil {
+		return err
+	}
+
+	// ==== A person already inside is not counted twice ====
+	if occupancy.entered[entryLogInput.PersonalID] {
+		return nil
+	}
+	open, _, err := getOpenEntryLog(stub, entryLogInput.FacilityID, entryLogInput.PersonalID)
+	if err != nil {
+		return err
+	} else if open != nil {
+		return nil
+	}
+
+	registered, err := readFacility(stub, entryLogInput.FacilityID)
+	if err != nil {
+		return err
+	}
+	if registered != nil && registered.Capacity > 0 && occupancy.Occupancy >= registered.Capacity {
+		if config.CapacityPolicy == capacityPolicyReject {
+			return newError(errCodeResourceExhausted, "facilityID", "facility is at its capacity of %d: %s", registered.Capacity, entryLogInput.FacilityID)
+		}
+		entryLogInput.capacityExceeded = true
+	}
+
+	occupancy.Occupancy++
+	occupancy.delta++
+	occupancy.entered[entryLogInput.PersonalID] = true
+	if entryLogInput.entryTimestamp > occupancy.UpdatedTimestamp {
+		occupancy.UpdatedTimestamp = entryLogInput.entryTimestamp
+	}
+	entryLogInput.countedIn = true
+	return nil
+}
+
+// ===========================================================================
+// countExit - count a person out of a facility, the occupancy never goes below 0.
+// Nothing is counted under the off policy.
+// ===========================================================================
+func countExit(stub shim.ChaincodeStubInterface, config *chaincodeConfig, facilityID string, timestamp int64) error {
+	if config.CapacityPolicy == capacityPolicyOff {
+		return nil
+	}
+	occupancy, err := readOccupancy(stub, nil, facilityID)
+	if err != nil {
+		return err
+	}
+	if occupancy.Occupancy == 0 {
+		return nil
+	}
+	occupancy.Occupancy--
+	occupancy.delta--
+	if timestamp > occupancy.UpdatedTimestamp {
+		occupancy.UpdatedTimestamp = timestamp
+	}
+	_, err = putOccupancy(stub, occupancy)
+	return err
+}
+
+// ===========================================================================
+// readOccupancy - the occupancy of a facility, from occupancies if it was read earlier
+// in the transaction, else the sum of its deltas, never below 0. occupancies may be nil.
+// ===========================================================================
+func readOccupancy(stub shim.ChaincodeStubInterface, occupancies map[string]*facilityOccupancy, facilityID string) (*facilityOccupancy, error) {
+	if occupancy, ok := occupancies[facilityID]; ok {
+		return occupancy, nil
+	}
+
+	resultsIterator, err := stub.GetPrivateDataByPartialCompositeKey("collectionEntryLog", occupancyObjectType, []string{facilityID})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	occupancy := &facilityOccupancy{FacilityID: facilityID, entered: make(map[string]bool)}
+	for resultsIterator.HasNext() {
+		res, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		delta := occupancyDelta{}
+		err = json.Unmarshal(res.Value, &delta)
+		if err != nil {
+			return nil, err
+		}
+		occupancy.Occupancy += delta.Occupancy
+		if delta.UpdatedTimestamp > occupancy.UpdatedTimestamp {
+			occupancy.UpdatedTimestamp = delta.UpdatedTimestamp
+		}
+		occupancy.keys = append(occupancy.keys, res.Key)
+	}
+	// exits counted concurrently against the same count may overshoot
+	if occupancy.Occupancy < 0 {
+		occupancy.Occupancy = 0
+	}
+
+	if occupancies != nil {
+		occupancies[facilityID] = occupancy
+	}
+	return occupancy, nil
+}
+
+// ===========================================================================
+// putOccupancy - write the delta of the transaction to the occupancy of a facility,
+// or the whole occupancy once there are maxOccupancyDeltas deltas, see foldOccupancy
+// ===========================================================================
+func putOccupancy(stub shim.ChaincodeStubInterface, occupancy *facilityOccupancy) ([]byte, error) {
+	if len(occupancy.keys) >= maxOccupancyDeltas {
+		err := foldOccupancy(stub, occupancy)
+		if err != nil {
+			return nil, err
+		}
+	}
+	delta := occupancy.delta
+	if occupancy.folded {
+		delta = occupancy.Occupancy
+	}
+
+	occupancyKey, err := stub.CreateCompositeKey(occupancyObjectType, []string{occupancy.FacilityID, stub.GetTxID()})
+	if err != nil {
+		return nil, err
+	}
+	occupancyAsBytes, err := json.Marshal(occupancyDelta{
+		ObjectType:       occupancyObjectType,
+		FacilityID:       occupancy.FacilityID,
+		Occupancy:        delta,
+		UpdatedTimestamp: occupancy.UpdatedTimestamp,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return occupancyAsBytes, stub.PutPrivateData("collectionEntryLog", occupancyKey, occupancyAsBytes)
+}
+
+// ===========================================================================
+// foldOccupancy - delete the deltas summed into occupancy, putOccupancy then writes
+// the sum as the delta of the transaction
+// ===========================================================================
+func foldOccupancy(stub shim.ChaincodeStubInterface, occupancy *facilityOccupancy) error {
+	for _, key := range occupancy.keys {
+		err := stub.DelPrivateData("collectionEntryLog", key)
+		if err != nil {
+			return err
+		}
+	}
+	occupancy.keys = nil
+	occupancy.folded = true
+	return nil
+}
@@ -0,0 +1,69 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestOccupancyDeltasAndFold(t *testing.T) {
+	stub := newPrivateDataStub()
+	config := &chaincodeConfig{CapacityPolicy: capacityPolicyFlag}
+
+	// countIn - one transaction counting a person in, as checkCapacity and putEntryLog do
+	countIn := func(tx int) {
+		stub.txID = fmt.Sprintf("tx%03d", tx)
+		occupancy, err := readOccupancy(stub, nil, "F1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		occupancy.Occupancy++
+		occupancy.delta++
+		_, err = putOccupancy(stub, occupancy)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	check := func(wantOccupancy int, wantDeltas int) {
+		occupancy, err := readOccupancy(stub, nil, "F1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if occupancy.Occupancy != wantOccupancy || len(occupancy.keys) != wantDeltas {
+			t.Errorf("got occupancy %d from %d deltas, want %d from %d", occupancy.Occupancy, len(occupancy.keys), wantOccupancy, wantDeltas)
+		}
+	}
+
+	for tx := 1; tx <= 5; tx++ {
+		countIn(tx)
+	}
+	check(5, 5)
+
+	stub.txID = "tx006"
+	err := countExit(stub, config, "F1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(4, 6)
+
+	// the transaction that reads maxOccupancyDeltas deltas replaces them with the sum
+	for tx := 7; tx <= maxOccupancyDeltas+1; tx++ {
+		countIn(tx)
+	}
+	check(maxOccupancyDeltas-1, 1)
+	countIn(maxOccupancyDeltas + 2)
+	check(maxOccupancyDeltas, 2)
+
+	// the off policy neither reads nor writes deltas
+	stub.txID = "tx999"
+	err = countExit(stub, &chaincodeConfig{CapacityPolicy: capacityPolicyOff}, "F1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(maxOccupancyDeltas, 2)
+}
@@ -0,0 +1,481 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Private data queries have no paging in this Fabric version, so pages are cut from
+// the indexes facility~entryLog and personal~entryLog, which both collections keep for
+// every entryLog. An index is read in key order, i.e. by entryLogID, and the bookmark is
+// the base64 of the last index key returned.
+//
+// Composite keys cannot be read by range, so the keys of these two indexes are range keys,
+// "\x01<indexName>\x01<key>\x01<entryLogID>\x01", and a page is one range query from the
+// bookmark on. Range keys sort below every entryLogID, see migrateEntryLogs.
+//
+// Index keys that are still composite keys are merged into the pages until migrateEntryLogs
+// rewrote them, see readIndexKey. Entries stored before the indexes existed in
+// collectionEntryLog are only paged once migrateEntryLogs added their index keys.
+const (
+	facilityEntryLogIndex = "facility~entryLog"
+	personalEntryLogIndex = "personal~entryLog"
+	rangeKeyDelimiter     = "\x01"
+	rangeKeyNamespaceEnd  = "\x02" // the first key after every range key
+)
+
+// rangeIndexes are the indexes kept under range keys, the others use composite keys
+var rangeIndexes = map[string]bool{
+	facilityEntryLogIndex: true,
+	personalEntryLogIndex: true,
+}
+
+const maxPageSize = 100
+
+// ===========================================================================
+// parsePageArgs - the optional pageSize and bookmark arguments of a query,
+// pageSize 0 if the caller wants every record at once
+// ===========================================================================
+func parsePageArgs(args []string) (int, string, error) {
+	if len(args) > 2 {
+		return 0, "", newError(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting an optional pageSize and bookmark")
+	}
+	if len(args) == 0 || len(args[0]) == 0 {
+		if len(args) == 2 && len(args[1]) != 0 {
+			return 0, "", newError(errCodeRequired, "pageSize", "pageSize must be given with a bookmark")
+		}
+		return 0, "", nil
+	}
+
+	pageSize, err := strconv.Atoi(args[0])
+	if err != nil || pageSize < 1 || pageSize > maxPageSize {
+		return 0, "", newError(errCodeOutOfRange, "pageSize", "pageSize must be a number between 1 and %d", maxPageSize)
+	}
+	bookmark := ""
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+	return pageSize, bookmark, nil
+}
+
+// ===========================================================================
+// getIndexPage - the entryLogIDs indexed under indexName for any of keys in collection,
+// one page after bookmark. The returned bookmark is empty once the last page was read.
+// ===========================================================================
+func getIndexPage(stub shim.ChaincodeStubInterface, collection string, indexName string, keys []string, pageSize int, bookmark string) ([]string, string, error) {
+	// ==== Find where the previous page stopped ====
+	startRange := 0
+	startKey := ""
+	if len(bookmark) != 0 {
+		bookmarkKey, err := base64.RawURLEncoding.DecodeString(bookmark)
+		if err != nil {
+			return nil, "", newError(errCodeInvalidFormat, "bookmark", "bookmark is not one returned by this query")
+		}
+		bookmarkIndex, attributes, err := splitRangeKey(string(bookmarkKey))
+		if err != nil || bookmarkIndex != indexName || len(attributes) != 2 {
+			return nil, "", newError(errCodeInvalidArgument, "bookmark", "bookmark is not one returned by this query")
+		}
+		startRange = -1
+		for i, key := range keys {
+			if key == attributes[0] {
+				startRange = i
+			}
+		}
+		if startRange < 0 {
+			return nil, "", newError(errCodeInvalidArgument, "bookmark", "bookmark is not one returned by this query")
+		}
+		startKey = string(bookmarkKey)
+	}
+
+	// ==== Read one record more than the page to know whether another page follows ====
+	var entryLogIDs []string
+	var indexKeys []string
+	for i := startRange; i < len(keys) && len(entryLogIDs) <= pageSize; i++ {
+		rangeStart := ""
+		if i == startRange {
+			rangeStart = startKey
+		}
+		keyIDs, err := readIndexKey(stub, collection, indexName, keys[i], rangeStart, pageSize+1-len(entryLogIDs))
+		if err != nil {
+			return nil, "", err
+		}
+		for _, entryLogID := range keyIDs {
+			// the bookmark is a range key even when the entry came from a legacy composite key
+			indexKey, err := createRangeKey(indexName, []string{keys[i], entryLogID})
+			if err != nil {
+				return nil, "", err
+			}
+			entryLogIDs = append(entryLogIDs, entryLogID)
+			indexKeys = append(indexKeys, indexKey)
+		}
+	}
+
+	if len(entryLogIDs) <= pageSize {
+		return entryLogIDs, "", nil
+	}
+	return entryLogIDs[:pageSize], base64.RawURLEncoding.EncodeToString([]byte(indexKeys[pageSize-1])), nil
+}
+
+// ===========================================================================
+// readIndexKey - up to limit entryLogIDs indexed under key, in order, after the range key
+// startKey if it is set. The range keys are merged with the composite keys of entries
+// migrateEntryLogs did not reach yet, which cannot be read by range and are read whole.
+// ===========================================================================
+func readIndexKey(stub shim.ChaincodeStubInterface, collection string, indexName string, key string, startKey string, limit int) ([]string, error) {
+	prefix, err := createRangeKey(indexName, []string{key})
+	if err != nil {
+		return nil, err
+	}
+	afterID := ""
+	if len(startKey) != 0 {
+		_, attributes, err := splitRangeKey(startKey)
+		if err != nil || len(attributes) != 2 {
+			return nil, fmt.Errorf("malformed %s index key %q", indexName, startKey)
+		}
+		afterID = attributes[1]
+	}
+
+	legacyIDs, err := readLegacyIndexKey(stub, collection, indexName, key, afterID)
+	if err != nil {
+		return nil, err
+	}
+
+	// the range starts at the bookmark, which is skipped, and ends after the last key under prefix
+	rangeStart := prefix
+	if len(startKey) != 0 {
+		rangeStart = startKey
+	}
+	resultsIterator, err := stub.GetPrivateDataByRange(collection, rangeStart, prefix[:len(prefix)-1]+rangeKeyNamespaceEnd)
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var entryLogIDs []string
+	for len(entryLogIDs) < limit {
+		rangeID := ""
+		for rangeID == "" && resultsIterator.HasNext() {
+			res, err := resultsIterator.Next()
+			if err != nil {
+				return nil, err
+			}
+			if res.Key == startKey {
+				continue
+			}
+			_, attributes, err := splitRangeKey(res.Key)
+			if err != nil || len(attributes) != 2 {
+				return nil, fmt.Errorf("malformed %s index key %q", indexName, res.Key)
+			}
+			rangeID = attributes[1]
+		}
+
+		// ==== Take the legacy keys that sort before the range key, or all that are left ====
+		for len(legacyIDs) != 0 && len(entryLogIDs) < limit && (rangeID == "" || legacyIDs[0] < rangeID) {
+			entryLogIDs = append(entryLogIDs, legacyIDs[0])
+			legacyIDs = legacyIDs[1:]
+		}
+		if rangeID == "" || len(entryLogIDs) == limit {
+			break
+		}
+		// an entry indexed under both keys is listed once
+		if len(legacyIDs) != 0 && legacyIDs[0] == rangeID {
+			legacyIDs = legacyIDs[1:]
+		}
+		entryLogIDs = append(entryLogIDs, rangeID)
+	}
+	return entryLogIDs, nil
+}
+
+// ===========================================================================
+// readLegacyIndexKey - the entryLogIDs after afterID, in order, still indexed under key
+// by a composite key
+// ===========================================================================
+func readLegacyIndexKey(stub shim.ChaincodeStubInterface, collection string, indexName string, key string, afterID string) ([]string, error) {
+	resultsIterator, err := stub.GetPrivateDataByPartialCompositeKey(collection, indexName, []string{key})
+	if err != nil {
+		return nil, err
+	}
+	defer resultsIterator.Close()
+
+	var entryLogIDs []string
+	for resultsIterator.HasNext() {
+		res, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, attributes, err := stub.SplitCompositeKey(res.Key)
+		if err != nil || len(attributes) != 2 {
+			return nil, fmt.Errorf("malformed %s index key %q", indexName, res.Key)
+		}
+		if attributes[1] > afterID {
+			entryLogIDs = append(entryLogIDs, attributes[1])
+		}
+	}
+	sort.Strings(entryLogIDs)
+	return entryLogIDs, nil
+}
+
+// ===========================================================================
+// createRangeKey - the key of attributes in a range index, see the note on paging.
+// A key of fewer attributes is the prefix of the keys that start with them.
+// ===========================================================================
+func createRangeKey(indexName string, attributes []string) (string, error) {
+	for _, attribute := range append([]string{indexName}, attributes...) {
+		if !utf8.ValidString(attribute) || strings.ContainsAny(attribute, "\x00"+rangeKeyDelimiter) {
+			return "", fmt.Errorf("%q cannot be part of a range key", attribute)
+		}
+	}
+	return rangeKeyDelimiter + indexName + rangeKeyDelimiter + strings.Join(attributes, rangeKeyDelimiter) + rangeKeyDelimiter, nil
+}
+
+// splitRangeKey - the index name and attributes of a range key
+func splitRangeKey(key string) (string, []string, error) {
+	if len(key) < 2 || !strings.HasPrefix(key, rangeKeyDelimiter) || !strings.HasSuffix(key, rangeKeyDelimiter) {
+		return "", nil, fmt.Errorf("%q is not a range key", key)
+	}
+	parts := strings.Split(key[1:len(key)-1], rangeKeyDelimiter)
+	return parts[0], parts[1:], nil
+}
+
+// createIndexKey - the key of attributes in indexName, a range key or a composite key
+func createIndexKey(stub shim.ChaincodeStubInterface, indexName string, attributes []string) (string, error) {
+	if rangeIndexes[indexName] {
+		return createRangeKey(indexName, attributes)
+	}
+	return stub.CreateCompositeKey(indexName, attributes)
+}
+
+// ===========================================================================
+// pageResponse - wrap the JSON array of a page's records with the page metadata
+// ===========================================================================
+func pageResponse(records []byte, fetched int, bookmark string) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"records":             json.RawMessage(records),
+		"fetchedRecordsCount": fetched,
+		"bookmark":            bookmark,
+	})
+}
+
+// ===========================================================================
+// unpagedResponse - the JSON array of an unpaged query's records, or if the query was
+// cut at maxQueryLimit the records wrapped like a page with truncated set. The bookmark
+// reads on with a pageSize; it is empty for a rich query, which has none.
+// ===========================================================================
+func unpagedResponse(records []byte, fetched int, truncated bool, bookmark string) ([]byte, error) {
+	if !truncated {
+		return records, nil
+	}
+	return json.Marshal(map[string]interface{}{
+		"records":             json.RawMessage(records),
+		"fetchedRecordsCount": fetched,
+		"bookmark":            bookmark,
+		"truncated":           true,
+	})
+}
+
+// ===========================================================================
+// getEntryLogsByCompositeKey - the entryLogs listed under any of keys in the index of
+// collectionEntryLog, a page after bookmark or the first maxQueryLimit if pageSize is 0
+// ===========================================================================
+func getEntryLogsByCompositeKey(stub shim.ChaincodeStubInterface, keys []string, indexName string, pageSize int, bookmark string) ([]byte, error) {
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	limit := pageSize
+	if limit == 0 {
+		limit = maxQueryLimit
+	}
+	entryLogIDs, nextBookmark, err := getIndexPage(stub, "collectionEntryLog", indexName, keys, limit, bookmark)
+	if err != nil {
+		return nil, err
+	}
+
+	// buffer is a JSON array containing QueryRecords
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	fetched := 0
+	for _, entryLogID := range entryLogIDs {
+		entryLogAsBytes, err := stub.GetPrivateData("collectionEntryLog", entryLogID)
+		if err != nil {
+			return nil, err
+		} else if entryLogAsBytes == nil {
+			// the index entry outlived its record
+			continue
+		}
+
+		// older records are returned in the current schema
+		entry, _, err := readEntryLog(config, entryLogAsBytes)
+		if err != nil {
+			return nil, err
+		}
+		entryLogJSONasBytes, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add a comma before array members, suppress it for the first array member
+		if fetched > 0 {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"Key\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(entryLogID)
+		buffer.WriteString("\"")
+
+		buffer.WriteString(", \"Record\":")
+		// Record is a JSON object, so we write as-is
+		buffer.WriteString(string(entryLogJSONasBytes))
+		buffer.WriteString("}")
+		fetched++
+	}
+	buffer.WriteString("]")
+
+	if pageSize == 0 {
+		return unpagedResponse(buffer.Bytes(), fetched, len(nextBookmark) != 0, nextBookmark)
+	}
+	return pageResponse(buffer.Bytes(), fetched, nextBookmark)
+}
+
+// ===========================================================================
+// putEntryLogIndexes - list an entryLog under its facility and person in collectionEntryLog,
+// by ID and by time
+// ===========================================================================
+func putEntryLogIndexes(stub shim.ChaincodeStubInterface, entry *entryLog) error {
+	for _, index := range entryLogIndexKeys(entry) {
+		indexKey, err := createIndexKey(stub, index.name, index.attributes)
+		if err != nil {
+			return err
+		}
+		err = stub.PutPrivateData("collectionEntryLog", indexKey, []byte{0x00})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ===========================================================================
+// delEntryLogIndexes - remove the index keys putEntryLogIndexes wrote for an entryLog
+// ===========================================================================
+func delEntryLogIndexes(stub shim.ChaincodeStubInterface, entry *entryLog) error {
+	return delIndexKeys(stub, "collectionEntryLog", entryLogIndexKeys(entry))
+}
+
+// ===========================================================================
+// delIndexKeys - remove index keys from collection, with the composite keys a range
+// index was kept under before
+// ===========================================================================
+func delIndexKeys(stub shim.ChaincodeStubInterface, collection string, indexes []indexKeyParts) error {
+	for _, index := range indexes {
+		indexKey, err := createIndexKey(stub, index.name, index.attributes)
+		if err != nil {
+			return err
+		}
+		err = stub.DelPrivateData(collection, indexKey)
+		if err != nil {
+			return err
+		}
+		if !rangeIndexes[index.name] {
+			continue
+		}
+		compositeKey, err := stub.CreateCompositeKey(index.name, index.attributes)
+		if err != nil {
+			return err
+		}
+		err = stub.DelPrivateData(collection, compositeKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ===========================================================================
+// ensureEntryLogIndexes - add the index keys an entryLog is missing, report whether any were
+// ===========================================================================
+func ensureEntryLogIndexes(stub shim.ChaincodeStubInterface, entry *entryLog) (bool, error) {
+	return ensureIndexKeys(stub, "collectionEntryLog", entryLogIndexKeys(entry))
+}
+
+// ===========================================================================
+// ensureIndexKeys - add the index keys collection is missing, report whether any were.
+// A range index key replaces the composite key the index was kept under before.
+// ===========================================================================
+func ensureIndexKeys(stub shim.ChaincodeStubInterface, collection string, indexes []indexKeyParts) (bool, error) {
+	added := false
+	for _, index := range indexes {
+		indexKey, err := createIndexKey(stub, index.name, index.attributes)
+		if err != nil {
+			return false, err
+		}
+		indexAsBytes, err := stub.GetPrivateData(collection, indexKey)
+		if err != nil {
+			return false, err
+		} else if indexAsBytes != nil {
+			continue
+		}
+		err = stub.PutPrivateData(collection, indexKey, []byte{0x00})
+		if err != nil {
+			return false, err
+		}
+		added = true
+
+		if rangeIndexes[index.name] {
+			compositeKey, err := stub.CreateCompositeKey(index.name, index.attributes)
+			if err != nil {
+				return false, err
+			}
+			err = stub.DelPrivateData(collection, compositeKey)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	return added, nil
+}
+
+type indexKeyParts struct {
+	name       string
+	attributes []string
+}
+
+// entryLogIndexKeys - the keys of an entryLog in the ID and time indexes of collectionEntryLog
+func entryLogIndexKeys(entry *entryLog) []indexKeyParts {
+	return append([]indexKeyParts{
+		{facilityEntryLogIndex, []string{entry.FacilityID, entry.EntryLogID}},
+		{facilityTimeIndex, timeIndexAttributes(entry.FacilityID, entry)},
+	}, personIndexKeys(entry.PersonalID, entry)...)
+}
+
+// personIndexKeys - the keys of an entryLog in the indexes by personalID
+func personIndexKeys(personalID string, entry *entryLog) []indexKeyParts {
+	return []indexKeyParts{
+		{personalEntryLogIndex, []string{personalID, entry.EntryLogID}},
+		{personTimeIndex, timeIndexAttributes(personalID, entry)},
+	}
+}
+
+// privateDetailsIndexKeys - the keys of an entryLog's private details in the indexes of
+// collectionEntryLogPrivateDetails
+func privateDetailsIndexKeys(details *entryLogPrivateDetails) []indexKeyParts {
+	return []indexKeyParts{
+		{facilityEntryLogIndex, []string{details.FacilityID, details.EntryLogID}},
+		{personalEntryLogIndex, []string{details.PersonalID, details.EntryLogID}},
+	}
+}
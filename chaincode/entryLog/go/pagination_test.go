@@ -0,0 +1,54 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGetIndexPageMergesLegacyCompositeKeys(t *testing.T) {
+	stub := newPrivateDataStub()
+	index := func(key string) {
+		stub.PutPrivateData("collectionEntryLog", key, []byte{0x00})
+	}
+	for _, entryLogID := range []string{"E2", "E4", "E5"} {
+		key, _ := createRangeKey(facilityEntryLogIndex, []string{"F1", entryLogID})
+		index(key)
+	}
+	// E1 and E3 were indexed before range keys, E4 under both until migrateEntryLogs deletes the old key
+	for _, entryLogID := range []string{"E1", "E3", "E4"} {
+		key, _ := stub.CreateCompositeKey(facilityEntryLogIndex, []string{"F1", entryLogID})
+		index(key)
+	}
+	legacyKey, _ := stub.CreateCompositeKey(facilityEntryLogIndex, []string{"F10", "E6"})
+	index(legacyKey)
+
+	entryLogIDs, bookmark, err := getIndexPage(stub, "collectionEntryLog", facilityEntryLogIndex, []string{"F1"}, 10, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"E1", "E2", "E3", "E4", "E5"}; !reflect.DeepEqual(entryLogIDs, want) || bookmark != "" {
+		t.Errorf("got %v and bookmark %q, want %v and no bookmark", entryLogIDs, bookmark, want)
+	}
+
+	var pages [][]string
+	bookmark = ""
+	for {
+		entryLogIDs, bookmark, err = getIndexPage(stub, "collectionEntryLog", facilityEntryLogIndex, []string{"F1"}, 2, bookmark)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pages = append(pages, entryLogIDs)
+		if bookmark == "" || len(pages) > 3 {
+			break
+		}
+	}
+	if want := [][]string{{"E1", "E2"}, {"E3", "E4"}, {"E5"}}; !reflect.DeepEqual(pages, want) {
+		t.Errorf("got pages %v, want %v", pages, want)
+	}
+}
@@ -0,0 +1,193 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// A person's name, phone and address are stored once, in a profile keyed by the
+// composite key person~<personalID> in collectionEntryLogPrivateDetails.
+// entryLogPrivateDetails only reference the profile through their personalID.
+// The profile shares the collection's blockToLive and is rewritten by every entry newer
+// than its updatedTimestamp, so an address changed by updateAddress is kept until then.
+// Name, phone and address are stored encrypted, see sealPersonProfile.
+const personProfileObjectType = "person"
+
+type personProfile struct {
+	ObjectType       string `json:"docType"`
+	PersonalID       string `json:"personalID"`
+	Name             string `json:"name,omitempty"`
+	Phone            string `json:"phone,omitempty"`
+	Address          string `json:"address,omitempty"`
+	KeyID            string `json:"keyID,omitempty"`            // ID of the key name, phone and address are encrypted with
+	Ciphertext       string `json:"ciphertext,omitempty"`       // base64 of the GCM nonce and sealed name, phone and address
+	UpdatedTimestamp int64  `json:"updatedTimestamp,omitempty"` // UTC epoch seconds of the entry or update that last wrote the profile
+}
+
+// ===========================================================================
+// getPersonProfile - read the profile of a person. Args: personalID, raw or pseudonym.
+// Transient: pseudonymKey, needed for a raw personalID;
+// encryptionKey and encryptionKeyID, to decrypt name, phone and address
+// ===========================================================================
+func (t *SimpleChaincode) getPersonProfile(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting personalID of the profile to query")
+	}
+
+	key, err := getPseudonymKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	personalIDs, err := personalIDAliases(key, "personalID", args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	enc, err := getEncryptionKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	profile, err := findPersonProfile(stub, personalIDs)
+	if err != nil {
+		return toErrorResponse(err)
+	} else if profile == nil {
+		return errorResponse(errCodeNotFound, "personalID", "person profile does not exist: %s", args[0])
+	}
+	err = openPersonProfile(enc, profile)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	profileAsBytes, err := json.Marshal(profile)
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+	return shim.Success(profileAsBytes)
+}
+
+// ===========================================================================
+// readPersonProfile - read and decode a profile, nil if the person has none
+// ===========================================================================
+func readPersonProfile(stub shim.ChaincodeStubInterface, personalID string) (*personProfile, error) {
+	profileKey, err := stub.CreateCompositeKey(personProfileObjectType, []string{personalID})
+	if err != nil {
+		return nil, err
+	}
+
+	profileAsBytes, err := stub.GetPrivateData("collectionEntryLogPrivateDetails", profileKey)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get person profile: %s", err.Error())
+	} else if profileAsBytes == nil {
+		return nil, nil
+	}
+
+	profile := &personProfile{}
+	err = json.Unmarshal(profileAsBytes, profile)
+	if err != nil {
+		return nil, err
+	}
+	return profile, nil
+}
+
+// ===========================================================================
+// findPersonProfile - the profile stored under the first of personalIDs that has one
+// ===========================================================================
+func findPersonProfile(stub shim.ChaincodeStubInterface, personalIDs []string) (*personProfile, error) {
+	for _, personalID := range personalIDs {
+		profile, err := readPersonProfile(stub, personalID)
+		if err != nil || profile != nil {
+			return profile, err
+		}
+	}
+	return nil, nil
+}
+
+// ===========================================================================
+// putPersonProfile - save a profile, replacing the one stored for its person
+// ===========================================================================
+func putPersonProfile(stub shim.ChaincodeStubInterface, profile *personProfile) error {
+	profileKey, err := stub.CreateCompositeKey(personProfileObjectType, []string{profile.PersonalID})
+	if err != nil {
+		return err
+	}
+
+	profile.ObjectType = personProfileObjectType
+	profileAsBytes, err := json.Marshal(profile)
+	if err != nil {
+		return err
+	}
+	return stub.PutPrivateData("collectionEntryLogPrivateDetails", profileKey, profileAsBytes)
+}
+
+// ===========================================================================
+// updatePersonProfile - seal profile with enc and save it, unless the stored profile of the
+// person was updated at or after its updatedTimestamp. profiles caches the profiles read
+// or written earlier in the transaction, whose writes the transaction cannot read back.
+// ===========================================================================
+func updatePersonProfile(stub shim.ChaincodeStubInterface, enc *encryptionKey, profiles map[string]*personProfile, profile *personProfile) error {
+	stored, ok := profiles[profile.PersonalID]
+	if !ok {
+		var err error
+		stored, err = readPersonProfile(stub, profile.PersonalID)
+		if err != nil {
+			return err
+		}
+		profiles[profile.PersonalID] = stored
+	}
+	if stored != nil && stored.UpdatedTimestamp >= profile.UpdatedTimestamp {
+		return nil
+	}
+
+	err := sealPersonProfile(stub, enc, profile)
+	if err != nil {
+		return err
+	}
+	err = putPersonProfile(stub, profile)
+	if err != nil {
+		return err
+	}
+	profiles[profile.PersonalID] = profile
+	return nil
+}
+
+// ===========================================================================
+// joinPersonProfile - fill name, phone and address of details from the person's profile,
+// decrypted with enc. Without the key of the profile only its keyID is filled in.
+// Details stored before the profiles existed keep their own copy when there is no profile.
+// profiles caches the profiles already read, nil entries included.
+// ===========================================================================
+func joinPersonProfile(stub shim.ChaincodeStubInterface, enc *encryptionKey, details *entryLogPrivateDetails, profiles map[string]*personProfile) error {
+	profile, ok := profiles[details.PersonalID]
+	if !ok {
+		var err error
+		profile, err = readPersonProfile(stub, details.PersonalID)
+		if err != nil {
+			return err
+		}
+		profiles[details.PersonalID] = profile
+	}
+	if profile == nil {
+		return nil
+	}
+
+	opened := *profile
+	err := openPersonProfile(enc, &opened)
+	if err != nil {
+		return err
+	}
+	details.Name = opened.Name
+	details.Phone = opened.Phone
+	details.Address = opened.Address
+	details.KeyID = opened.KeyID
+	return nil
+}
@@ -0,0 +1,358 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Statistics asked for with an epsilon get Laplace noise on every count. Each person
+// counts once, at their first visit in the window, so a person changes one bucket of each
+// of the statisticsBreakdowns by one and every count gets noise of scale breakdowns/epsilon.
+// The noise is drawn from an HMAC of the transaction ID under a secret noise seed, so every
+// endorser adds the same but a client, who picks the transaction ID with its nonce, cannot
+// foresee it. The seed is set by an admin of noiseSeedMSPID with setNoiseSeed and kept in
+// collectionNoiseSeed, which only that org holds; its peers endorse noisy statistics and
+// its clients cannot ask for them. The collection is not memberOnlyRead, so its peers
+// endorse for the other orgs, and no function returns the seed.
+//
+// Each org spends its epsilon from a privacy budget kept in world state under
+// privacyBudget~<mspID>, the config's privacyBudget until an admin sets another limit.
+// A noisy result is not returned by the transaction that computes it: it is stored under
+// visitStatistics~<txID> and read with getVisitStatisticsResult once committed, so an org
+// cannot see results without spending its budget, by evaluating or by retrying.
+const (
+	privacyBudgetObjectType   = "privacyBudget"
+	visitStatisticsObjectType = "visitStatistics"
+	statisticsBreakdowns      = 5 // total, byDay, byHour, byGender, byBirthDecade
+	maxStatisticsEpsilon      = 1.0
+	privacyBudgetTolerance    = 1e-9 // epsilons are summed as floats
+)
+
+const (
+	noiseSeedCollection   = "collectionNoiseSeed"
+	noiseSeedKey          = "noiseSeed"
+	noiseSeedTransientKey = "noiseSeed"
+	noiseSeedMSPID        = "Org1MSP" // the only member of collectionNoiseSeed
+	minNoiseSeedLength    = 32
+)
+
+type privacyBudget struct {
+	ObjectType string  `json:"docType"`
+	MSPID      string  `json:"mspID"`
+	Limit      float64 `json:"limit"` // total epsilon the org may spend
+	Spent      float64 `json:"spent"`
+}
+
+// visitStatisticsResult is a noisy getVisitStatistics result, readable by the org that paid for it
+type visitStatisticsResult struct {
+	ObjectType string          `json:"docType"`
+	RequestID  string          `json:"requestID"` // ID of the transaction that computed it
+	MSPID      string          `json:"mspID"`
+	Epsilon    float64         `json:"epsilon"`
+	Statistics json.RawMessage `json:"statistics"`
+}
+
+// laplaceNoise draws the noise of one result, see the note on noisy statistics
+type laplaceNoise struct {
+	seed  []byte
+	txID  string
+	scale float64
+}
+
+// ===========================================================================
+// getVisitStatisticsResult - read the noisy statistics computed by a getVisitStatistics
+// transaction of the caller's org. Args: requestID
+// ===========================================================================
+func (t *SimpleChaincode) getVisitStatisticsResult(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 1 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting requestID")
+	}
+	requestID := args[0]
+
+	resultKey, err := stub.CreateCompositeKey(visitStatisticsObjectType, []string{requestID})
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	resultAsBytes, err := stub.GetState(resultKey)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get statistics result: %s", err.Error())
+	} else if resultAsBytes == nil {
+		return errorResponse(errCodeNotFound, "requestID", "statistics result does not exist: %s", requestID)
+	}
+
+	result := visitStatisticsResult{}
+	err = json.Unmarshal(resultAsBytes, &result)
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+	callerOrg, err := cid.GetMSPID(stub)
+	if err != nil {
+		return errorResponse(errCodePermissionDenied, "", "Failed to get the MSP ID of the caller: %s", err.Error())
+	}
+	// another org's result is not revealed to exist
+	if result.MSPID != callerOrg {
+		return errorResponse(errCodeNotFound, "requestID", "statistics result does not exist: %s", requestID)
+	}
+
+	return shim.Success(resultAsBytes)
+}
+
+// ===========================================================================
+// getPrivacyBudget - the privacy budget of an org, only admins see another org's.
+// Args: mspID (optional, the caller's org)
+// ===========================================================================
+func (t *SimpleChaincode) getPrivacyBudget(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) > 1 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting an optional mspID")
+	}
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return errorResponse(errCodePermissionDenied, "", "Failed to get the MSP ID of the caller: %s", err.Error())
+	}
+	if len(args) == 1 && len(args[0]) != 0 && args[0] != mspID {
+		roles, err := callerRoles(stub)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+		if !containsString(roles, roleAdmin) {
+			return errorResponse(errCodePermissionDenied, "mspID", "Caller may only read the privacy budget of %s", mspID)
+		}
+		mspID = args[0]
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get config: %s", err.Error())
+	}
+	budget, err := readPrivacyBudget(stub, config, mspID)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	budgetAsBytes, err := json.Marshal(budget)
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+	return shim.Success(budgetAsBytes)
+}
+
+// ===========================================================================
+// setPrivacyBudget - change the total epsilon an org may spend, what it spent is kept.
+// Args: mspID, limit
+// ===========================================================================
+func (t *SimpleChaincode) setPrivacyBudget(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start set privacy budget")
+
+	if len(args) != 2 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting mspID and limit")
+	}
+	if len(args[0]) == 0 {
+		return errorResponse(errCodeRequired, "mspID", "mspID must be a non-empty string")
+	}
+	limit, err := strconv.ParseFloat(args[1], 64)
+	if err != nil || math.IsNaN(limit) || math.IsInf(limit, 0) || limit < 0 {
+		return errorResponse(errCodeOutOfRange, "limit", "limit must be a number not below 0")
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get config: %s", err.Error())
+	}
+	budget, err := readPrivacyBudget(stub, config, args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	budget.Limit = limit
+	budgetAsBytes, err := putPrivacyBudget(stub, budget)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to put privacy budget: %s", err.Error())
+	}
+
+	fmt.Println("- end set privacy budget (success)")
+	return shim.Success(budgetAsBytes)
+}
+
+// ===========================================================================
+// setNoiseSeed - set the secret noisy statistics are drawn with, see the note on noise.
+// Only an admin of noiseSeedMSPID may. Transient: noiseSeed, at least 32 bytes
+// ===========================================================================
+func (t *SimpleChaincode) setNoiseSeed(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start set noise seed")
+
+	if len(args) != 0 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. The noise seed must be passed in transient map.")
+	}
+	callerOrg, err := cid.GetMSPID(stub)
+	if err != nil {
+		return errorResponse(errCodePermissionDenied, "", "Failed to get the MSP ID of the caller: %s", err.Error())
+	}
+	if callerOrg != noiseSeedMSPID {
+		return errorResponse(errCodePermissionDenied, "", "only admins of %s may set the noise seed", noiseSeedMSPID)
+	}
+
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Error getting transient: %s", err.Error())
+	}
+	seed, ok := transMap[noiseSeedTransientKey]
+	if !ok {
+		return errorResponse(errCodeRequired, noiseSeedTransientKey, "%s must be a key in the transient map", noiseSeedTransientKey)
+	}
+	if len(seed) < minNoiseSeedLength {
+		return errorResponse(errCodeOutOfRange, noiseSeedTransientKey, "%s must be at least %d bytes", noiseSeedTransientKey, minNoiseSeedLength)
+	}
+	err = stub.PutPrivateData(noiseSeedCollection, noiseSeedKey, seed)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to put noise seed: %s", err.Error())
+	}
+
+	fmt.Println("- end set noise seed (success)")
+	return shim.Success(nil)
+}
+
+// parseEpsilon - the epsilon argument of a noisy statistics query
+func parseEpsilon(value string) (float64, error) {
+	epsilon, err := strconv.ParseFloat(value, 64)
+	if err != nil || math.IsNaN(epsilon) || epsilon <= 0 || epsilon > maxStatisticsEpsilon {
+		return 0, newError(errCodeOutOfRange, "epsilon", "epsilon must be a number above 0 and at most %g", maxStatisticsEpsilon)
+	}
+	return epsilon, nil
+}
+
+// ===========================================================================
+// spendPrivacyBudget - charge epsilon to the caller's org, refused if it would go over its limit
+// ===========================================================================
+func spendPrivacyBudget(stub shim.ChaincodeStubInterface, config *chaincodeConfig, epsilon float64) (*privacyBudget, error) {
+	mspID, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, newError(errCodePermissionDenied, "", "Failed to get the MSP ID of the caller: %s", err.Error())
+	}
+	budget, err := readPrivacyBudget(stub, config, mspID)
+	if err != nil {
+		return nil, err
+	}
+	if budget.Spent+epsilon > budget.Limit+privacyBudgetTolerance {
+		return nil, newError(errCodeResourceExhausted, "epsilon", "privacy budget of %s exceeded: %g of %g spent, %g asked", mspID, budget.Spent, budget.Limit, epsilon)
+	}
+
+	budget.Spent += epsilon
+	_, err = putPrivacyBudget(stub, budget)
+	if err != nil {
+		return nil, err
+	}
+	return budget, nil
+}
+
+// ===========================================================================
+// readPrivacyBudget - the budget of an org, a fresh one with the config's limit if none is stored
+// ===========================================================================
+func readPrivacyBudget(stub shim.ChaincodeStubInterface, config *chaincodeConfig, mspID string) (*privacyBudget, error) {
+	budgetKey, err := stub.CreateCompositeKey(privacyBudgetObjectType, []string{mspID})
+	if err != nil {
+		return nil, err
+	}
+	budgetAsBytes, err := stub.GetState(budgetKey)
+	if err != nil {
+		return nil, err
+	} else if budgetAsBytes == nil {
+		return &privacyBudget{ObjectType: privacyBudgetObjectType, MSPID: mspID, Limit: config.PrivacyBudget}, nil
+	}
+
+	budget := &privacyBudget{}
+	err = json.Unmarshal(budgetAsBytes, budget)
+	if err != nil {
+		return nil, err
+	}
+	return budget, nil
+}
+
+func putPrivacyBudget(stub shim.ChaincodeStubInterface, budget *privacyBudget) ([]byte, error) {
+	budgetKey, err := stub.CreateCompositeKey(privacyBudgetObjectType, []string{budget.MSPID})
+	if err != nil {
+		return nil, err
+	}
+	budgetAsBytes, err := json.Marshal(budget)
+	if err != nil {
+		return nil, err
+	}
+	return budgetAsBytes, stub.PutState(budgetKey, budgetAsBytes)
+}
+
+// ===========================================================================
+// putVisitStatisticsResult - store noisy statistics under the transaction ID for the caller's org
+// ===========================================================================
+func putVisitStatisticsResult(stub shim.ChaincodeStubInterface, budget *privacyBudget, epsilon float64, statistics []byte) error {
+	result := &visitStatisticsResult{
+		ObjectType: visitStatisticsObjectType,
+		RequestID:  stub.GetTxID(),
+		MSPID:      budget.MSPID,
+		Epsilon:    epsilon,
+		Statistics: statistics,
+	}
+	resultKey, err := stub.CreateCompositeKey(visitStatisticsObjectType, []string{result.RequestID})
+	if err != nil {
+		return err
+	}
+	resultAsBytes, err := json.Marshal(result)
+	if err != nil {
+		return err
+	}
+	return stub.PutState(resultKey, resultAsBytes)
+}
+
+// ===========================================================================
+// newLaplaceNoise - the noise of the transaction's result, drawn with the noise seed.
+// A caller of noiseSeedMSPID, which could foresee it, is refused.
+// ===========================================================================
+func newLaplaceNoise(stub shim.ChaincodeStubInterface, epsilon float64) (*laplaceNoise, error) {
+	callerOrg, err := cid.GetMSPID(stub)
+	if err != nil {
+		return nil, newError(errCodePermissionDenied, "", "Failed to get the MSP ID of the caller: %s", err.Error())
+	}
+	if callerOrg == noiseSeedMSPID {
+		return nil, newError(errCodePermissionDenied, "epsilon", "%s holds the noise seed and cannot ask for noisy statistics", noiseSeedMSPID)
+	}
+
+	seed, err := stub.GetPrivateData(noiseSeedCollection, noiseSeedKey)
+	if err != nil {
+		return nil, err
+	} else if seed == nil {
+		return nil, newError(errCodeConflict, "epsilon", "this peer has no noise seed, noisy statistics are endorsed by peers of %s once an admin called setNoiseSeed", noiseSeedMSPID)
+	}
+	return &laplaceNoise{seed: seed, txID: stub.GetTxID(), scale: statisticsBreakdowns / epsilon}, nil
+}
+
+// count - value plus the noise drawn for label, rounded and never below 0
+func (n *laplaceNoise) count(label string, value int) int {
+	// ==== A uniform u in (0, 1) from the seed, transaction and label, then the inverse Laplace CDF ====
+	mac := hmac.New(sha256.New, n.seed)
+	mac.Write([]byte(n.txID + "\x00" + label))
+	hash := mac.Sum(nil)
+	u := (float64(binary.BigEndian.Uint64(hash[:8])>>11) + 0.5) / (1 << 53)
+	var noise float64
+	if u < 0.5 {
+		noise = n.scale * math.Log(2*u)
+	} else {
+		noise = -n.scale * math.Log(2*(1-u))
+	}
+
+	noisy := int(math.Floor(float64(value) + noise + 0.5))
+	if noisy < 0 {
+		return 0
+	}
+	return noisy
+}
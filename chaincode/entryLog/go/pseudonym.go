@@ -0,0 +1,266 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The ledger never stores a raw personalID. The chaincode keeps
+// pid-<hex HMAC-SHA256(key, raw ID)> in its place: in entryLogs, private details,
+// person profiles and every composite key. A value that already is a pseudonym is
+// taken as is and needs no key.
+//
+// The pseudonym key is held by the health authority, whose admin passes it to
+// registerPseudonymKey. It is kept in pseudonymKeyCollection, which only the peers of
+// Org1 and Org3 hold, so transactions they endorse pseudonymize raw IDs without the key
+// in the transient map: NFC readers and the person app never hold it. The collection is
+// not memberOnlyRead, so those peers endorse for every org, and no function returns the
+// key. A client may still pass the key in the transient map, for peers without a copy.
+const (
+	pseudonymKeyTransientKey = "pseudonymKey"
+	pseudonymPrefix          = "pid-"
+	minPseudonymKeyLength    = 32
+)
+
+const (
+	pseudonymKeyCollection = "collectionPseudonymKey"
+	pseudonymKeyPrivateKey = "pseudonymKey"
+)
+
+// pseudonymKeyCheckKey is the world state key of an HMAC of a fixed message under the
+// pseudonym key. An admin writes it once with registerPseudonymKey; it lets every
+// transaction reject a different key, which would split a person's entries.
+const pseudonymKeyCheckKey = "pseudonymKeyCheck"
+
+const pseudonymKeyCheckMessage = "entryLog pseudonym key check"
+
+// ===========================================================================
+// registerPseudonymKey - store the check of the pseudonym key the ledger is pseudonymized
+// with, and the key in pseudonymKeyCollection. Transient: pseudonymKey. Registering the
+// same key again succeeds and stores it again, another key is refused.
+// ===========================================================================
+func (t *SimpleChaincode) registerPseudonymKey(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start register pseudonym key")
+
+	if len(args) != 0 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. The pseudonym key must be passed in transient map.")
+	}
+	key, err := readPseudonymKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	} else if key == nil {
+		return errorResponse(errCodeRequired, pseudonymKeyTransientKey, "%s must be a key in the transient map", pseudonymKeyTransientKey)
+	}
+
+	storedCheck, err := stub.GetState(pseudonymKeyCheckKey)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get pseudonym key check: %s", err.Error())
+	} else if storedCheck != nil {
+		if !hmac.Equal(storedCheck, pseudonymKeyCheck(key)) {
+			return errorResponse(errCodeConflict, pseudonymKeyTransientKey, "the ledger is already pseudonymized with another key")
+		}
+	} else {
+		err = stub.PutState(pseudonymKeyCheckKey, pseudonymKeyCheck(key))
+		if err != nil {
+			return errorResponse(errCodeLedgerError, "", "Failed to put pseudonym key check: %s", err.Error())
+		}
+	}
+	err = stub.PutPrivateData(pseudonymKeyCollection, pseudonymKeyPrivateKey, key)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to put pseudonym key: %s", err.Error())
+	}
+
+	fmt.Println("- end register pseudonym key (success)")
+	return shim.Success(nil)
+}
+
+// ===========================================================================
+// getPseudonymKey - the pseudonym key of the transient map, else the endorsing peer's
+// copy in pseudonymKeyCollection, nil if there is neither. The key must be the one
+// registered with registerPseudonymKey; nothing is written.
+// ===========================================================================
+func getPseudonymKey(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	key, err := readPseudonymKey(stub)
+	if err != nil {
+		return nil, err
+	}
+	if key == nil {
+		// a peer outside the collection has no copy
+		key, err = stub.GetPrivateData(pseudonymKeyCollection, pseudonymKeyPrivateKey)
+		if err != nil || key == nil {
+			return nil, err
+		}
+	}
+
+	storedCheck, err := stub.GetState(pseudonymKeyCheckKey)
+	if err != nil {
+		return nil, err
+	} else if storedCheck == nil {
+		return nil, newError(errCodeConflict, pseudonymKeyTransientKey, "no pseudonym key is registered, an admin must call registerPseudonymKey first")
+	} else if !hmac.Equal(storedCheck, pseudonymKeyCheck(key)) {
+		return nil, newError(errCodePermissionDenied, pseudonymKeyTransientKey, "%s is not the key the ledger was pseudonymized with", pseudonymKeyTransientKey)
+	}
+	return key, nil
+}
+
+// readPseudonymKey - the pseudonym key of the transient map if it is long enough, nil if none was passed
+func readPseudonymKey(stub shim.ChaincodeStubInterface) ([]byte, error) {
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+	key, ok := transMap[pseudonymKeyTransientKey]
+	if !ok {
+		return nil, nil
+	}
+	if len(key) < minPseudonymKeyLength {
+		return nil, newError(errCodeOutOfRange, pseudonymKeyTransientKey, "%s must be at least %d bytes", pseudonymKeyTransientKey, minPseudonymKeyLength)
+	}
+	return key, nil
+}
+
+// pseudonymKeyCheck - the value stored under pseudonymKeyCheckKey for key
+func pseudonymKeyCheck(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(pseudonymKeyCheckMessage))
+	return []byte(hex.EncodeToString(mac.Sum(nil)))
+}
+
+// ===========================================================================
+// pseudonymize - the pseudonym of a raw personalID under key
+// ===========================================================================
+func pseudonymize(key []byte, personalID string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(personalID))
+	return pseudonymPrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// ===========================================================================
+// resolvePersonalID - the pseudonym a raw personalID or pseudonym stands for.
+// A raw ID needs the key; without it the error names the transient key to pass.
+// ===========================================================================
+func resolvePersonalID(key []byte, field string, value string) (string, error) {
+	err := validatePersonalID(field, value)
+	if err != nil {
+		return "", err
+	}
+	if pseudonymPattern.MatchString(value) {
+		return value, nil
+	}
+	if key == nil {
+		return "", newError(errCodeRequired, pseudonymKeyTransientKey, "this peer holds no pseudonym key, %s must be a key in the transient map to use a raw %s", pseudonymKeyTransientKey, field)
+	}
+	return pseudonymize(key, value), nil
+}
+
+// ===========================================================================
+// personalIDAliases - the IDs records of a person can be stored under: the pseudonym,
+// and the raw ID for records that were not migrated yet, if the raw ID was given
+// ===========================================================================
+func personalIDAliases(key []byte, field string, value string) ([]string, error) {
+	pseudonym, err := resolvePersonalID(key, field, value)
+	if err != nil {
+		return nil, err
+	}
+	if pseudonym == value {
+		return []string{pseudonym}, nil
+	}
+	return []string{pseudonym, value}, nil
+}
+
+// ===========================================================================
+// pseudonymizeEntryLog - replace the raw personalID of a stored entryLog with its
+// pseudonym, along with its private details, index keys, open marker and the
+// person's profile. The caller writes entry and details back.
+// profiles caches the profiles of the current migration page by pseudonym.
+// ===========================================================================
+func pseudonymizeEntryLog(stub shim.ChaincodeStubInterface, key []byte, profiles map[string]*personProfile, entry *entryLog, details *entryLogPrivateDetails) error {
+	rawID := entry.PersonalID
+	pseudonym := pseudonymize(key, rawID)
+
+	// ==== Move the open marker, if it is this entryLog's ====
+	open, openEntryLogKey, err := getOpenEntryLog(stub, entry.FacilityID, rawID)
+	if err != nil {
+		return err
+	}
+	entry.PersonalID = pseudonym
+	if open != nil && open.EntryLogID == entry.EntryLogID {
+		err = stub.DelPrivateData("collectionEntryLog", openEntryLogKey)
+		if err != nil {
+			return err
+		}
+		err = putOpenEntryLog(stub, entry)
+		if err != nil {
+			return err
+		}
+	}
+
+	// ==== Drop the raw personalID from the indexes in collectionEntryLog, migrateEntryLog adds the pseudonym ====
+	err = delIndexKeys(stub, "collectionEntryLog", personIndexKeys(rawID, entry))
+	if err != nil {
+		return err
+	}
+
+	if details == nil {
+		return nil
+	}
+
+	// ==== Move the personal~entryLog index entry ====
+	err = delIndexKeys(stub, "collectionEntryLogPrivateDetails", []indexKeyParts{{personalEntryLogIndex, []string{rawID, entry.EntryLogID}}})
+	if err != nil {
+		return err
+	}
+	indexKey, err := createIndexKey(stub, personalEntryLogIndex, []string{pseudonym, entry.EntryLogID})
+	if err != nil {
+		return err
+	}
+	err = stub.PutPrivateData("collectionEntryLogPrivateDetails", indexKey, []byte{0x00})
+	if err != nil {
+		return err
+	}
+	details.PersonalID = pseudonym
+
+	// ==== Move the profile, once per person and page ====
+	if _, ok := profiles[pseudonym]; ok {
+		return nil
+	}
+	profile, err := readPersonProfile(stub, pseudonym)
+	if err != nil {
+		return err
+	}
+	rawProfile, err := readPersonProfile(stub, rawID)
+	if err != nil {
+		return err
+	}
+	if rawProfile != nil {
+		if profile == nil || rawProfile.UpdatedTimestamp > profile.UpdatedTimestamp {
+			rawProfile.PersonalID = pseudonym
+			profile = rawProfile
+			err = putPersonProfile(stub, profile)
+			if err != nil {
+				return err
+			}
+		}
+		rawProfileKey, err := stub.CreateCompositeKey(personProfileObjectType, []string{rawID})
+		if err != nil {
+			return err
+		}
+		err = stub.DelPrivateData("collectionEntryLogPrivateDetails", rawProfileKey)
+		if err != nil {
+			return err
+		}
+	}
+	profiles[pseudonym] = profile
+	return nil
+}
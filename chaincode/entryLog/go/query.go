@@ -0,0 +1,204 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Ad hoc queries are CouchDB queries of the form {"selector": {...}, "limit": n}.
+// The selector is a flat object of conditions on queryableFields, each a value or
+// an object of selectorOperators; docType is always entryLog. To keep a query from
+// scanning the whole collection it must match one of anchorFields by $eq or $in, each
+// has an index in META-INF/statedb/couchdb/collections/collectionEntryLog/indexes,
+// under its legacy name too for the fields selectorWithLegacyFields rewrites.
+const (
+	maxQueryLimit    = 100
+	maxQueryInValues = 50
+)
+
+var queryableFields = map[string]bool{
+	"entryLogID":       true,
+	"facilityID":       true,
+	"personalID":       true,
+	"tagUID":           true,
+	"readerID":         true,
+	"year":             true,
+	"gender":           true,
+	"entryTime":        true,
+	"entryTimestamp":   true,
+	"entryTimeFlagged": true,
+	"capacityExceeded": true,
+	"exitTime":         true,
+	"exitTimestamp":    true,
+	"dwellSeconds":     true,
+}
+
+var anchorFields = []string{"entryLogID", "facilityID", "personalID"}
+
+var selectorOperators = map[string]bool{
+	"$eq":     true,
+	"$ne":     true,
+	"$gt":     true,
+	"$gte":    true,
+	"$lt":     true,
+	"$lte":    true,
+	"$in":     true,
+	"$exists": true,
+}
+
+// ===========================================================================
+// parseEntryLogQuery - validate an ad hoc query and rewrite it for the state database.
+// Returns the query string to run and the most records it may return.
+// ===========================================================================
+func parseEntryLogQuery(queryString string) (string, int, error) {
+	type entryLogQuery struct {
+		Selector map[string]interface{} `json:"selector"`
+		Limit    int                    `json:"limit"`
+	}
+
+	var query entryLogQuery
+	err := decodeStrict([]byte(queryString), &query)
+	if err != nil {
+		return "", 0, err
+	}
+	if query.Selector == nil {
+		return "", 0, newError(errCodeRequired, "selector", "queryString must have a selector object")
+	}
+	if query.Limit < 1 || query.Limit > maxQueryLimit {
+		return "", 0, newError(errCodeOutOfRange, "limit", "limit must be a number between 1 and %d", maxQueryLimit)
+	}
+
+	selector := make(map[string]interface{})
+	anchored := false
+	for _, field := range sortedKeys(query.Selector) {
+		condition := query.Selector[field]
+		if field == "docType" {
+			if condition != "entryLog" {
+				return "", 0, newError(errCodeOutOfRange, "selector.docType", "docType can only be entryLog")
+			}
+			continue
+		}
+
+		// records before schema version 3 are matched by selectorWithLegacyFields
+		name := canonicalFieldName(field)
+		if !queryableFields[name] {
+			return "", 0, newError(errCodeInvalidArgument, "selector."+field, "%s is not a field entryLogs can be queried by", field)
+		}
+		if _, ok := selector[name]; ok {
+			return "", 0, newError(errCodeInvalidArgument, "selector."+field, "%s is given more than once", name)
+		}
+
+		equality, err := validateCondition("selector."+field, condition)
+		if err != nil {
+			return "", 0, err
+		}
+		if equality && containsString(anchorFields, name) {
+			anchored = true
+		}
+		selector[name] = condition
+	}
+	if !anchored {
+		return "", 0, newError(errCodeInvalidArgument, "selector", "selector must match %s by value, $eq or $in", strings.Join(anchorFields, ", "))
+	}
+
+	selector["docType"] = "entryLog"
+	queryAsBytes, err := json.Marshal(map[string]interface{}{
+		"selector": selectorWithLegacyFields(selector),
+		"limit":    query.Limit,
+	})
+	if err != nil {
+		return "", 0, err
+	}
+	return string(queryAsBytes), query.Limit, nil
+}
+
+// ===========================================================================
+// validateCondition - the condition must be a value or an object of allowed operators.
+// Reports whether it only matches by equality, with $eq or $in.
+// ===========================================================================
+func validateCondition(field string, condition interface{}) (bool, error) {
+	operators, ok := condition.(map[string]interface{})
+	if !ok {
+		return true, validateQueryValue(field, condition)
+	}
+	if len(operators) == 0 {
+		return false, newError(errCodeInvalidArgument, field, "%s must have at least one operator", field)
+	}
+
+	equality := true
+	for _, operator := range sortedKeys(operators) {
+		operand := operators[operator]
+		if !selectorOperators[operator] {
+			return false, newError(errCodeInvalidArgument, field+"."+operator, "%s is not an allowed operator", operator)
+		}
+
+		var err error
+		switch operator {
+		case "$in":
+			err = validateInOperand(field+".$in", operand)
+		case "$exists":
+			if _, ok := operand.(bool); !ok {
+				err = newError(errCodeInvalidFormat, field+".$exists", "$exists must be true or false")
+			}
+		default:
+			err = validateQueryValue(field+"."+operator, operand)
+		}
+		if err != nil {
+			return false, err
+		}
+		if operator != "$eq" && operator != "$in" {
+			equality = false
+		}
+	}
+	return equality, nil
+}
+
+func validateInOperand(field string, operand interface{}) error {
+	values, ok := operand.([]interface{})
+	if !ok || len(values) == 0 || len(values) > maxQueryInValues {
+		return newError(errCodeOutOfRange, field, "$in must be an array of 1 to %d values", maxQueryInValues)
+	}
+	for _, value := range values {
+		err := validateQueryValue(field, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateQueryValue - operands are strings, numbers or booleans, never objects
+func validateQueryValue(field string, value interface{}) error {
+	switch value.(type) {
+	case string, float64, bool:
+		return nil
+	}
+	return newError(errCodeInvalidFormat, field, "%s must be a string, number or boolean", field)
+}
+
+// canonicalFieldName - the current name of a field also known by its legacy name
+func canonicalFieldName(field string) string {
+	for _, names := range legacyFieldNames {
+		if field == names.legacy {
+			return names.canonical
+		}
+	}
+	return field
+}
+
+// sortedKeys - the keys of m in order, so endorsers report the same first error
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,102 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// matchSelector - whether record satisfies a selector of the shape parseEntryLogQuery
+// writes: field values, $in, $and and $or
+func matchSelector(t *testing.T, selector map[string]interface{}, record map[string]interface{}) bool {
+	for field, condition := range selector {
+		switch field {
+		case "$and", "$or":
+			any := false
+			for _, branch := range condition.([]interface{}) {
+				matched := matchSelector(t, branch.(map[string]interface{}), record)
+				if field == "$and" && !matched {
+					return false
+				}
+				any = any || matched
+			}
+			if field == "$or" && !any {
+				return false
+			}
+		default:
+			operators, ok := condition.(map[string]interface{})
+			if !ok {
+				operators = map[string]interface{}{"$eq": condition}
+			}
+			for operator, operand := range operators {
+				switch operator {
+				case "$eq":
+					if record[field] != operand {
+						return false
+					}
+				case "$in":
+					found := false
+					for _, value := range operand.([]interface{}) {
+						found = found || record[field] == value
+					}
+					if !found {
+						return false
+					}
+				default:
+					t.Fatalf("operator %s is not supported by the test", operator)
+				}
+			}
+		}
+	}
+	return true
+}
+
+func TestParseEntryLogQueryMatchesLegacyFields(t *testing.T) {
+	records := []string{
+		`{"docType":"entryLog","entryLogID":"E1","facilityID":"F1","personalID":"P1"}`,
+		`{"docType":"entryLog","EntryLogID":"E2","FacilityID":"F1","personalID":"P1"}`,
+		`{"docType":"entryLog","EntryLogID":"E3","FacilityID":"F2","personalID":"P1"}`,
+	}
+	tests := []struct {
+		query string
+		want  []bool
+	}{
+		{`{"selector":{"facilityID":"F1"},"limit":10}`, []bool{true, true, false}},
+		{`{"selector":{"FacilityID":"F1"},"limit":10}`, []bool{true, true, false}},
+		{`{"selector":{"facilityID":{"$in":["F2"]},"personalID":"P1"},"limit":10}`, []bool{false, false, true}},
+		{`{"selector":{"entryLogID":"E2","facilityID":"F1"},"limit":10}`, []bool{false, true, false}},
+	}
+
+	for _, test := range tests {
+		queryString, _, err := parseEntryLogQuery(test.query)
+		if err != nil {
+			t.Fatalf("%s: %s", test.query, err)
+		}
+		var query struct {
+			Selector map[string]interface{} `json:"selector"`
+		}
+		err = json.Unmarshal([]byte(queryString), &query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if query.Selector["docType"] != "entryLog" {
+			t.Errorf("%s: docType is not a top-level condition of %s", test.query, queryString)
+		}
+
+		for i, recordString := range records {
+			var record map[string]interface{}
+			err = json.Unmarshal([]byte(recordString), &record)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := matchSelector(t, query.Selector, record); got != test.want[i] {
+				t.Errorf("%s: %s matched %v, want %v", queryString, recordString, got, test.want[i])
+			}
+		}
+	}
+}
@@ -0,0 +1,399 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// entryLogSchemaVersion is the schemaVersion written with new entryLog and
+// entryLogPrivateDetails records. Records without the field are version 1.
+//
+//	1 - original records
+//	2 - entryLog carries entryTimestamp, the UTC epoch of entryTime
+//	3 - canonical camelCase field names; earlier records store EntryLogID and FacilityID
+//	4 - entryLogPrivateDetails reference the person profile instead of copying name, phone and address
+//	5 - personalID is a keyed pseudonym; records stay at 4 until migrated with the pseudonym key
+const entryLogSchemaVersion = 5
+
+// legacyFieldNames pairs canonical field names with the capitalized names that
+// records before schema version 3 were stored with
+var legacyFieldNames = []struct{ canonical, legacy string }{
+	{"entryLogID", "EntryLogID"},
+	{"facilityID", "FacilityID"},
+}
+
+// maxMigrationPageSize bounds the records upgraded by one migrateEntryLogs call
+const maxMigrationPageSize = 200
+
+// ===========================================================================
+// readEntryLog - decode a stored entryLog and upgrade it to the current schema in memory
+// ===========================================================================
+func readEntryLog(config *chaincodeConfig, entryLogAsBytes []byte) (*entryLog, bool, error) {
+	entry := &entryLog{}
+	err := json.Unmarshal(entryLogAsBytes, entry)
+	if err != nil {
+		return nil, false, err
+	}
+	return entry, upgradeEntryLog(config, entry), nil
+}
+
+// ===========================================================================
+// readEntryLogPrivateDetails - decode stored private details and upgrade them in memory
+// ===========================================================================
+func readEntryLogPrivateDetails(detailsAsBytes []byte) (*entryLogPrivateDetails, bool, error) {
+	details := &entryLogPrivateDetails{}
+	err := json.Unmarshal(detailsAsBytes, details)
+	if err != nil {
+		return nil, false, err
+	}
+	return details, upgradeEntryLogPrivateDetails(details), nil
+}
+
+// ===========================================================================
+// upgradeEntryLog - apply the schema steps entry is missing, report whether it changed
+// ===========================================================================
+func upgradeEntryLog(config *chaincodeConfig, entry *entryLog) bool {
+	if entry.SchemaVersion >= entryLogSchemaVersion {
+		return false
+	}
+	fromVersion := entry.SchemaVersion
+	if entry.SchemaVersion < 1 {
+		entry.SchemaVersion = 1
+	}
+
+	if entry.SchemaVersion < 2 {
+		// a legacy entryTime that cannot be parsed keeps a zero timestamp
+		if entry.EntryTimestamp == 0 {
+			entryTime, err := parseEntryTime(config, entry.EntryTime)
+			if err == nil {
+				entry.EntryTimestamp = entryTime.Unix()
+			}
+		}
+		entry.SchemaVersion = 2
+	}
+
+	if entry.SchemaVersion < 3 {
+		// decoding is case-insensitive, writing the record back is all it takes
+		entry.SchemaVersion = 3
+	}
+
+	// version 4 only changed the private details
+	if entry.SchemaVersion < 4 {
+		entry.SchemaVersion = 4
+	}
+
+	// a raw personalID needs the pseudonym key, see pseudonymizeEntryLog
+	if pseudonymPattern.MatchString(entry.PersonalID) {
+		entry.SchemaVersion = 5
+	}
+
+	return entry.SchemaVersion != fromVersion
+}
+
+// ===========================================================================
+// upgradeEntryLogPrivateDetails - apply the schema steps details are missing
+// ===========================================================================
+func upgradeEntryLogPrivateDetails(details *entryLogPrivateDetails) bool {
+	if details.SchemaVersion >= entryLogSchemaVersion {
+		return false
+	}
+	fromVersion := details.SchemaVersion
+
+	// the private details gained camelCase field names in version 3. Their name, phone
+	// and address move to the person profile in version 4, which needs the ledger:
+	// migrateEntryLog does it, readers use the copy until then.
+	if details.SchemaVersion < 4 {
+		details.SchemaVersion = 4
+	}
+	if pseudonymPattern.MatchString(details.PersonalID) {
+		details.SchemaVersion = 5
+	}
+	return details.SchemaVersion != fromVersion
+}
+
+// ===========================================================================
+// migrateEntryLogs - rewrite stored records in the current schema, one page per call.
+// Args: pageSize, bookmark (the entryLogID to start from, empty for the first page).
+// Transient: pseudonymKey (optional), raw personalIDs are only replaced when it is given;
+// encryptionKey and encryptionKeyID (optional), person profiles in clear are only encrypted when they are given.
+// The returned bookmark is empty once every record was visited.
+// ===========================================================================
+func (t *SimpleChaincode) migrateEntryLogs(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start migrate entry logs")
+
+	if len(args) < 1 || len(args) > 2 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting pageSize and an optional bookmark")
+	}
+
+	pageSize, err := strconv.Atoi(args[0])
+	if err != nil || pageSize < 1 || pageSize > maxMigrationPageSize {
+		return errorResponse(errCodeOutOfRange, "pageSize", "pageSize must be a number between 1 and %d", maxMigrationPageSize)
+	}
+	bookmark := ""
+	if len(args) == 2 {
+		bookmark = args[1]
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get config: %s", err.Error())
+	}
+	key, err := getPseudonymKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	enc, err := getEncryptionKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	// composite index keys are not part of a range query and range index keys sort first,
+	// so starting after them only the records are visited
+	if len(bookmark) == 0 {
+		bookmark = rangeKeyNamespaceEnd
+	}
+	resultsIterator, err := stub.GetPrivateDataByRange("collectionEntryLog", bookmark, "")
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	fetched := 0
+	migrated := 0
+	nextBookmark := ""
+	// profiles written on this page by personalID, a transaction does not read its own writes
+	profiles := make(map[string]*personProfile)
+	for resultsIterator.HasNext() {
+		res, err := resultsIterator.Next()
+		if err != nil {
+			return toErrorResponse(err)
+		}
+		if fetched == pageSize {
+			nextBookmark = res.Key
+			break
+		}
+		fetched++
+
+		changed, err := migrateEntryLog(stub, config, key, enc, profiles, res.Key, res.Value)
+		if err != nil {
+			return errorResponse(errCodeLedgerError, "", "Failed to migrate %s: %s", res.Key, err.Error())
+		}
+		if changed {
+			migrated++
+		}
+	}
+
+	resultAsBytes, err := json.Marshal(map[string]interface{}{
+		"fetchedRecordsCount":  fetched,
+		"migratedRecordsCount": migrated,
+		"bookmark":             nextBookmark,
+	})
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+
+	fmt.Printf("- end migrate entry logs: %d fetched, %d migrated\n", fetched, migrated)
+	return shim.Success(resultAsBytes)
+}
+
+// ===========================================================================
+// migrateEntryLog - upgrade one entryLog and its private details, report whether anything was rewritten
+// ===========================================================================
+func migrateEntryLog(stub shim.ChaincodeStubInterface, config *chaincodeConfig, key []byte, enc *encryptionKey, profiles map[string]*personProfile, entryLogID string, entryLogAsBytes []byte) (bool, error) {
+	entry, entryChanged, err := readEntryLog(config, entryLogAsBytes)
+	if err != nil {
+		return false, err
+	}
+	if entry.ObjectType != "entryLog" {
+		return false, nil
+	}
+
+	var details *entryLogPrivateDetails
+	detailsChanged := false
+	detailsAsBytes, err := stub.GetPrivateData("collectionEntryLogPrivateDetails", entryLogID)
+	if err != nil {
+		return false, err
+	} else if detailsAsBytes != nil {
+		details, detailsChanged, err = readEntryLogPrivateDetails(detailsAsBytes)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if key != nil && !pseudonymPattern.MatchString(entry.PersonalID) {
+		err = pseudonymizeEntryLog(stub, key, profiles, entry, details)
+		if err != nil {
+			return false, err
+		}
+		entry.SchemaVersion = entryLogSchemaVersion
+		entryChanged = true
+		if details != nil {
+			details.SchemaVersion = entryLogSchemaVersion
+			detailsChanged = true
+		}
+	}
+
+	// ==== Entries stored before the paged and time window queries are added to their indexes ====
+	indexed, err := ensureEntryLogIndexes(stub, entry)
+	if err != nil {
+		return false, err
+	}
+
+	if entryChanged {
+		entryLogJSONasBytes, err := json.Marshal(entry)
+		if err != nil {
+			return false, err
+		}
+		err = stub.PutPrivateData("collectionEntryLog", entryLogID, entryLogJSONasBytes)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	if details == nil {
+		return entryChanged || indexed, nil
+	}
+	detailsIndexed, err := ensureIndexKeys(stub, "collectionEntryLogPrivateDetails", privateDetailsIndexKeys(details))
+	if err != nil {
+		return false, err
+	}
+	indexed = indexed || detailsIndexed
+	if len(details.Name) != 0 || len(details.Phone) != 0 || len(details.Address) != 0 {
+		err = moveToPersonProfile(stub, enc, profiles, details, entry.EntryTimestamp)
+		if err != nil {
+			return false, err
+		}
+		detailsChanged = true
+	}
+	// the ciphertext is bound to the personalID, profiles still under a raw ID stay in clear until pseudonymized
+	if enc != nil && pseudonymPattern.MatchString(details.PersonalID) {
+		err = encryptPersonProfile(stub, enc, profiles, details.PersonalID)
+		if err != nil {
+			return false, err
+		}
+	}
+	if detailsChanged {
+		detailsJSONasBytes, err := json.Marshal(details)
+		if err != nil {
+			return false, err
+		}
+		err = stub.PutPrivateData("collectionEntryLogPrivateDetails", entryLogID, detailsJSONasBytes)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return entryChanged || detailsChanged || indexed, nil
+}
+
+// ===========================================================================
+// moveToPersonProfile - move the copy of name, phone and address in details to the
+// person's profile, encrypted with enc if it is given. The copy replaces the profile
+// only if its entry is newer than what last wrote the profile; profiles caches the
+// profiles of the current page.
+// ===========================================================================
+func moveToPersonProfile(stub shim.ChaincodeStubInterface, enc *encryptionKey, profiles map[string]*personProfile, details *entryLogPrivateDetails, entryTimestamp int64) error {
+	profile, ok := profiles[details.PersonalID]
+	if !ok {
+		var err error
+		profile, err = readPersonProfile(stub, details.PersonalID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if profile == nil || entryTimestamp > profile.UpdatedTimestamp {
+		profile = &personProfile{
+			PersonalID:       details.PersonalID,
+			Name:             details.Name,
+			Phone:            details.Phone,
+			Address:          details.Address,
+			UpdatedTimestamp: entryTimestamp,
+		}
+		if enc != nil {
+			err := sealPersonProfile(stub, enc, profile)
+			if err != nil {
+				return err
+			}
+		}
+		err := putPersonProfile(stub, profile)
+		if err != nil {
+			return err
+		}
+	}
+	profiles[details.PersonalID] = profile
+
+	details.Name = ""
+	details.Phone = ""
+	details.Address = ""
+	return nil
+}
+
+// ===========================================================================
+// encryptPersonProfile - encrypt the profile of a person with enc if it is still in clear
+// ===========================================================================
+func encryptPersonProfile(stub shim.ChaincodeStubInterface, enc *encryptionKey, profiles map[string]*personProfile, personalID string) error {
+	profile, ok := profiles[personalID]
+	if !ok {
+		var err error
+		profile, err = readPersonProfile(stub, personalID)
+		if err != nil {
+			return err
+		}
+		profiles[personalID] = profile
+	}
+	if profile == nil || len(profile.Ciphertext) != 0 {
+		return nil
+	}
+
+	err := sealPersonProfile(stub, enc, profile)
+	if err != nil {
+		return err
+	}
+	return putPersonProfile(stub, profile)
+}
+
+// ===========================================================================
+// selectorWithLegacyFields - let a CouchDB selector on canonical field names also
+// match records stored before schema version 3. Each condition on entryLogID or
+// facilityID, in either casing, becomes an $or over both names; both have an index
+// on docType and the name, indexFacilityID and indexLegacyFacilityID for instance.
+// ===========================================================================
+func selectorWithLegacyFields(selector map[string]interface{}) map[string]interface{} {
+	var alternatives []interface{}
+	for _, names := range legacyFieldNames {
+		canonical, legacy := names.canonical, names.legacy
+		for _, field := range []string{canonical, legacy} {
+			condition, ok := selector[field]
+			if !ok {
+				continue
+			}
+			delete(selector, field)
+			alternatives = append(alternatives, map[string]interface{}{
+				"$or": []interface{}{
+					map[string]interface{}{canonical: condition},
+					map[string]interface{}{legacy: condition},
+				},
+			})
+		}
+	}
+	if len(alternatives) == 0 {
+		return selector
+	}
+
+	if and, ok := selector["$and"].([]interface{}); ok {
+		alternatives = append(and, alternatives...)
+	}
+	selector["$and"] = alternatives
+	return selector
+}
@@ -0,0 +1,352 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// Visit statistics count the entryLogs of a facility in a window from facility~time~entryLog,
+// by day and hour of the entry at the configured UTC offset, by gender and by birth decade.
+// A bucket that fewer than the config's kAnonymity distinct persons fall into is suppressed:
+// it is listed with no counts, so a count never stands for fewer than k people, and so
+// are enough other buckets of its breakdown that it cannot be told from the total.
+// Noisy statistics, asked for with an epsilon, are described in privacy.go.
+const unknownBucket = "unknown"
+
+// statBucket is one group of a breakdown, counts are nil when suppressed
+type statBucket struct {
+	Key        string `json:"key"`
+	Visits     *int   `json:"visits,omitempty"`
+	Persons    *int   `json:"persons,omitempty"`
+	Suppressed bool   `json:"suppressed,omitempty"`
+}
+
+// statCounter collects the visits and distinct persons of a bucket
+type statCounter struct {
+	visits  int
+	persons map[string]bool
+}
+
+// breakdown counts visits by the key a bucket function gives each entryLog
+type breakdown map[string]*statCounter
+
+func (b breakdown) add(key string, entry *entryLog) {
+	counter, ok := b[key]
+	if !ok {
+		counter = &statCounter{persons: make(map[string]bool)}
+		b[key] = counter
+	}
+	counter.visits++
+	counter.persons[entry.PersonalID] = true
+}
+
+// ===========================================================================
+// getVisitStatistics - aggregate visit counts of a facility, k-anonymous.
+// Args: facilityID, start, end (entryTime format, inclusive), epsilon (optional)
+// Facility operators only get the statistics of their org's facilities.
+// With an epsilon the counts are noisy and stored for getVisitStatisticsResult,
+// the response only tells the requestID and the budget left, see privacy.go.
+// ===========================================================================
+func (t *SimpleChaincode) getVisitStatistics(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start get visit statistics")
+
+	if len(args) != 3 && len(args) != 4 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting facilityID, start, end and an optional epsilon")
+	}
+	facilityID := args[0]
+	err := validatePattern("facilityID", facilityID, facilityIDPattern)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	err = assertStatisticsAccess(stub, facilityID)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	config, err := getConfig(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get config: %s", err.Error())
+	}
+	startTimestamp, endTimestamp, err := parseTimeWindow(config, args[1], args[2])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	epsilon := 0.0
+	if len(args) == 4 {
+		epsilon, err = parseEpsilon(args[3])
+		if err != nil {
+			return toErrorResponse(err)
+		}
+	}
+	entries, err := readTimeWindow(stub, config, facilityTimeIndex, []string{facilityID}, startTimestamp, endTimestamp)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	// ==== Count every entryLog into each breakdown ====
+	location := time.FixedZone("", config.EntryTimeOffsetMinutes*60)
+	total, byDay, byHour, byGender, byBirthDecade := breakdown{}, breakdown{}, breakdown{}, breakdown{}, breakdown{}
+	counted := make(map[string]bool)
+	for _, entry := range entries {
+		// with noise a person counts once, at their first visit
+		if epsilon > 0 && counted[entry.PersonalID] {
+			continue
+		}
+		counted[entry.PersonalID] = true
+
+		entryTime := time.Unix(entry.EntryTimestamp, 0).In(location)
+		total.add("total", entry)
+		byDay.add(entryTime.Format(timeIndexDayLayout), entry)
+		byHour.add(fmt.Sprintf("%02d", entryTime.Hour()), entry)
+		byGender.add(genderBucket(entry.Gender), entry)
+		byBirthDecade.add(birthDecadeBucket(entry.Year), entry)
+	}
+
+	k := config.KAnonymity
+	statistics := map[string]interface{}{
+		"facilityID":     facilityID,
+		"startTimestamp": startTimestamp,
+		"endTimestamp":   endTimestamp,
+		"k":              k,
+	}
+	if epsilon == 0 {
+		statistics["total"] = totalBucket(total, k)
+		statistics["byDay"] = byDay.buckets(k)
+		statistics["byHour"] = byHour.buckets(k)
+		statistics["byGender"] = byGender.buckets(k)
+		statistics["byBirthDecade"] = byBirthDecade.buckets(k)
+
+		statisticsAsBytes, err := json.Marshal(statistics)
+		if err != nil {
+			return errorResponse(errCodeInternal, "", "%s", err.Error())
+		}
+		fmt.Printf("- end get visit statistics: %d entries\n", len(entries))
+		return shim.Success(statisticsAsBytes)
+	}
+
+	// ==== Noisy counts, every possible bucket is listed so the keys tell nothing ====
+	budget, err := spendPrivacyBudget(stub, config, epsilon)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to get transaction time: %s", err.Error())
+	}
+	byDay.fill(dayBuckets(startTimestamp, endTimestamp, location))
+	byHour.fill(hourBuckets())
+	byGender.fill(genderBuckets())
+	byBirthDecade.fill(birthDecadeBuckets(txTime.Year()))
+	total.fill([]string{"total"})
+
+	noise, err := newLaplaceNoise(stub, epsilon)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	statistics["epsilon"] = epsilon
+	statistics["total"] = total.noisyBuckets(k, noise, "total")[0]
+	statistics["byDay"] = byDay.noisyBuckets(k, noise, "byDay")
+	statistics["byHour"] = byHour.noisyBuckets(k, noise, "byHour")
+	statistics["byGender"] = byGender.noisyBuckets(k, noise, "byGender")
+	statistics["byBirthDecade"] = byBirthDecade.noisyBuckets(k, noise, "byBirthDecade")
+
+	statisticsAsBytes, err := json.Marshal(statistics)
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+	err = putVisitStatisticsResult(stub, budget, epsilon, statisticsAsBytes)
+	if err != nil {
+		return errorResponse(errCodeLedgerError, "", "Failed to put statistics result: %s", err.Error())
+	}
+	receiptAsBytes, err := json.Marshal(map[string]interface{}{
+		"requestID": stub.GetTxID(),
+		"epsilon":   epsilon,
+		"budget":    budget,
+	})
+	if err != nil {
+		return errorResponse(errCodeInternal, "", "%s", err.Error())
+	}
+
+	fmt.Printf("- end get visit statistics: %d persons, epsilon %g\n", len(counted), epsilon)
+	return shim.Success(receiptAsBytes)
+}
+
+// ===========================================================================
+// assertStatisticsAccess - the health authority and admins see every facility,
+// facility operators only those their org owns
+// ===========================================================================
+func assertStatisticsAccess(stub shim.ChaincodeStubInterface, facilityID string) error {
+	roles, err := callerRoles(stub)
+	if err != nil {
+		return err
+	}
+	if containsString(roles, roleHealthAuthority) || containsString(roles, roleAdmin) {
+		return nil
+	}
+	return assertFacilityOwner(stub, facilityID)
+}
+
+// buckets - the groups of a breakdown in key order, those under k persons suppressed,
+// along with the complementary ones suppressComplements picks
+func (b breakdown) buckets(k int) []*statBucket {
+	keys := make([]string, 0, len(b))
+	for key := range b {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buckets := make([]*statBucket, 0, len(keys))
+	for _, key := range keys {
+		buckets = append(buckets, newStatBucket(key, b[key], k))
+	}
+	b.suppressComplements(buckets, k)
+	return buckets
+}
+
+// ===========================================================================
+// suppressComplements - the visits of a breakdown add up to the total, so a single
+// suppressed bucket could be worked out from the others. While the suppressed buckets
+// that are not empty are fewer than two, or hold fewer than k persons together, the
+// visible bucket with the fewest persons is suppressed as well.
+// ===========================================================================
+func (b breakdown) suppressComplements(buckets []*statBucket, k int) {
+	for {
+		hidden := 0
+		hiddenPersons := make(map[string]bool)
+		smallest := -1
+		for i, bucket := range buckets {
+			counter := b[bucket.Key]
+			if !bucket.Suppressed {
+				if smallest < 0 || len(counter.persons) < len(b[buckets[smallest].Key].persons) {
+					smallest = i
+				}
+				continue
+			}
+			if len(counter.persons) == 0 {
+				continue
+			}
+			hidden++
+			for personalID := range counter.persons {
+				hiddenPersons[personalID] = true
+			}
+		}
+
+		if hidden == 0 || (hidden >= 2 && len(hiddenPersons) >= k) || smallest < 0 {
+			return
+		}
+		buckets[smallest] = &statBucket{Key: buckets[smallest].Key, Suppressed: true}
+	}
+}
+
+// totalBucket - the counts over the whole window, suppressed like any other bucket
+func totalBucket(total breakdown, k int) *statBucket {
+	counter, ok := total["total"]
+	if !ok {
+		counter = &statCounter{persons: make(map[string]bool)}
+	}
+	return newStatBucket("total", counter, k)
+}
+
+func newStatBucket(key string, counter *statCounter, k int) *statBucket {
+	if len(counter.persons) < k {
+		return &statBucket{Key: key, Suppressed: true}
+	}
+	visits := counter.visits
+	persons := len(counter.persons)
+	return &statBucket{Key: key, Visits: &visits, Persons: &persons}
+}
+
+// fill - add an empty group for every key the breakdown does not have yet
+func (b breakdown) fill(keys []string) {
+	for _, key := range keys {
+		if _, ok := b[key]; !ok {
+			b[key] = &statCounter{persons: make(map[string]bool)}
+		}
+	}
+}
+
+// noisyBuckets - the groups of a breakdown in key order with noisy person counts,
+// those whose noisy count is under k suppressed. Visits equal persons under noise and are left out.
+func (b breakdown) noisyBuckets(k int, noise *laplaceNoise, name string) []*statBucket {
+	keys := make([]string, 0, len(b))
+	for key := range b {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buckets := make([]*statBucket, 0, len(keys))
+	for _, key := range keys {
+		persons := noise.count(name+"\x00"+key, len(b[key].persons))
+		if persons < k {
+			buckets = append(buckets, &statBucket{Key: key, Suppressed: true})
+			continue
+		}
+		buckets = append(buckets, &statBucket{Key: key, Persons: &persons})
+	}
+	return buckets
+}
+
+// dayBuckets - every local day the window touches
+func dayBuckets(startTimestamp int64, endTimestamp int64, location *time.Location) []string {
+	var keys []string
+	start := time.Unix(startTimestamp, 0).In(location)
+	day := time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, location)
+	for ; day.Unix() <= endTimestamp; day = day.AddDate(0, 0, 1) {
+		keys = append(keys, day.Format(timeIndexDayLayout))
+	}
+	return keys
+}
+
+func hourBuckets() []string {
+	keys := make([]string, 0, 24)
+	for hour := 0; hour < 24; hour++ {
+		keys = append(keys, fmt.Sprintf("%02d", hour))
+	}
+	return keys
+}
+
+func genderBuckets() []string {
+	keys := []string{unknownBucket}
+	for gender := range genders {
+		keys = append(keys, gender)
+	}
+	return keys
+}
+
+// birthDecadeBuckets - every decade a valid birth year can be in up to currentYear
+func birthDecadeBuckets(currentYear int) []string {
+	keys := []string{unknownBucket}
+	for decade := minBirthYear / 10 * 10; decade <= currentYear; decade += 10 {
+		keys = append(keys, strconv.Itoa(decade)+"s")
+	}
+	return keys
+}
+
+// genderBucket - the gender as the apps send it, unknown for anything else
+func genderBucket(gender string) string {
+	if genders[gender] {
+		return gender
+	}
+	return unknownBucket
+}
+
+// birthDecadeBucket - the decade of a birth year, 1990s for 1995
+func birthDecadeBucket(year string) string {
+	birthYear, err := strconv.Atoi(year)
+	if err != nil || birthYear < minBirthYear {
+		return unknownBucket
+	}
+	return strconv.Itoa(birthYear/10*10) + "s"
+}
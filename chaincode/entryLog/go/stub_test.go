@@ -0,0 +1,106 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"github.com/hyperledger/fabric/protos/ledger/queryresult"
+)
+
+// privateDataStub keeps private data in memory for the functions under test. Writes are
+// seen by later reads, unlike on a peer. Any other stub method panics.
+type privateDataStub struct {
+	shim.ChaincodeStubInterface
+	collections map[string]map[string][]byte
+	txID        string
+}
+
+func newPrivateDataStub() *privateDataStub {
+	return &privateDataStub{collections: make(map[string]map[string][]byte), txID: "tx1"}
+}
+
+func (stub *privateDataStub) GetTxID() string {
+	return stub.txID
+}
+
+func (stub *privateDataStub) GetPrivateData(collection, key string) ([]byte, error) {
+	return stub.collections[collection][key], nil
+}
+
+func (stub *privateDataStub) PutPrivateData(collection, key string, value []byte) error {
+	if stub.collections[collection] == nil {
+		stub.collections[collection] = make(map[string][]byte)
+	}
+	stub.collections[collection][key] = value
+	return nil
+}
+
+func (stub *privateDataStub) DelPrivateData(collection, key string) error {
+	delete(stub.collections[collection], key)
+	return nil
+}
+
+func (stub *privateDataStub) GetPrivateDataByRange(collection, startKey, endKey string) (shim.StateQueryIteratorInterface, error) {
+	if strings.HasPrefix(startKey, "\x00") || strings.HasPrefix(endKey, "\x00") {
+		return nil, fmt.Errorf("range keys cannot start with 0x00")
+	}
+	return stub.iterate(collection, startKey, endKey), nil
+}
+
+func (stub *privateDataStub) GetPrivateDataByPartialCompositeKey(collection, objectType string, attributes []string) (shim.StateQueryIteratorInterface, error) {
+	prefix, err := stub.CreateCompositeKey(objectType, attributes)
+	if err != nil {
+		return nil, err
+	}
+	return stub.iterate(collection, prefix, prefix+"\U0010ffff"), nil
+}
+
+func (stub *privateDataStub) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return "\x00" + objectType + "\x00" + strings.Join(append(attributes, ""), "\x00"), nil
+}
+
+func (stub *privateDataStub) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	parts := strings.Split(strings.TrimSuffix(strings.TrimPrefix(compositeKey, "\x00"), "\x00"), "\x00")
+	return parts[0], parts[1:], nil
+}
+
+// iterate - the keys of collection from startKey up to endKey, in order
+func (stub *privateDataStub) iterate(collection, startKey, endKey string) *kvIterator {
+	iterator := &kvIterator{}
+	for key, value := range stub.collections[collection] {
+		if key >= startKey && key < endKey {
+			iterator.kvs = append(iterator.kvs, &queryresult.KV{Key: key, Value: value})
+		}
+	}
+	sort.Slice(iterator.kvs, func(i, j int) bool { return iterator.kvs[i].Key < iterator.kvs[j].Key })
+	return iterator
+}
+
+type kvIterator struct {
+	kvs []*queryresult.KV
+}
+
+func (iterator *kvIterator) HasNext() bool {
+	return len(iterator.kvs) != 0
+}
+
+func (iterator *kvIterator) Next() (*queryresult.KV, error) {
+	if len(iterator.kvs) == 0 {
+		return nil, fmt.Errorf("no more results")
+	}
+	kv := iterator.kvs[0]
+	iterator.kvs = iterator.kvs[1:]
+	return kv, nil
+}
+
+func (iterator *kvIterator) Close() error {
+	return nil
+}
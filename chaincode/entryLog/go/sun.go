@@ -0,0 +1,293 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// NTAG 424 DNA tags answer every read with a Secure Unique NFC (SUN) message, see NXP AN12196:
+// the PICC data, i.e. UID and read counter AES encrypted under the SDM meta read key, and a
+// CMAC over the read under a session key derived from the SDM file read key, UID and counter.
+// A copied message carries a counter the tag already used, so every tag's last counter is kept.
+//
+// The keys of a tag are written by registerTag from the transient map and kept, with the last
+// counter, under the composite key nfcTagSUN~<tagUID> in collectionTagKeys, which only the
+// reader and facility orgs hold.
+const (
+	tagSUNObjectType    = "nfcTagSUN"
+	tagKeysTransientKey = "tagKeys"
+)
+
+// piccDataTagUIDAndCounter marks PICC data that mirrors a 7 byte UID and the read counter
+const piccDataTagUIDAndCounter = 0xc7
+
+var (
+	tagKeyPattern   = regexp.MustCompile(`^[0-9A-Fa-f]{32}$`)
+	piccDataPattern = regexp.MustCompile(`^[0-9A-Fa-f]{32}$`)
+	sunCMACPattern  = regexp.MustCompile(`^[0-9A-Fa-f]{16}$`)
+)
+
+type tagSUN struct {
+	ObjectType     string `json:"docType"`
+	TagUID         string `json:"tagUID"`
+	SDMMetaReadKey string `json:"sdmMetaReadKey"` // hex AES-128 key the PICC data is encrypted with
+	SDMFileReadKey string `json:"sdmFileReadKey"` // hex AES-128 key the session MAC key is derived from
+	ReadCounter    int    `json:"readCounter"`    // SDMReadCtr of the last accepted read, -1 before the first
+}
+
+// ===========================================================================
+// getTagKeys - the SUN keys of a tag passed to registerTag, nil if none were passed
+// ===========================================================================
+func getTagKeys(stub shim.ChaincodeStubInterface, tagUID string) (*tagSUN, error) {
+	type tagKeysTransientInput struct {
+		SDMMetaReadKey string `json:"sdmMetaReadKey"`
+		SDMFileReadKey string `json:"sdmFileReadKey"`
+	}
+
+	transMap, err := stub.GetTransient()
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := transMap[tagKeysTransientKey]; !ok {
+		return nil, nil
+	}
+
+	var input tagKeysTransientInput
+	err = decodeStrict(transMap[tagKeysTransientKey], &input)
+	if err != nil {
+		return nil, err
+	}
+	err = validatePattern("sdmMetaReadKey", input.SDMMetaReadKey, tagKeyPattern)
+	if err != nil {
+		return nil, err
+	}
+	err = validatePattern("sdmFileReadKey", input.SDMFileReadKey, tagKeyPattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &tagSUN{
+		ObjectType:     tagSUNObjectType,
+		TagUID:         tagUID,
+		SDMMetaReadKey: strings.ToLower(input.SDMMetaReadKey),
+		SDMFileReadKey: strings.ToLower(input.SDMFileReadKey),
+		ReadCounter:    -1,
+	}, nil
+}
+
+// ===========================================================================
+// verifyTagSUN - check the SUN message of an entryLog read from tag. The tag's SUN record
+// with the new counter is left in the entryLog input: validateEntryLogInput takes the
+// counter once the entryLog is accepted and putEntryLog saves it, so a rejected entryLog
+// does not use it up. counters holds the counters accepted earlier in the transaction.
+// ===========================================================================
+func verifyTagSUN(stub shim.ChaincodeStubInterface, tag *nfcTag, entryLogInput *entryLogTransientInput, counters map[string]int) error {
+	if len(entryLogInput.PICCData) == 0 && len(entryLogInput.CMAC) == 0 {
+		return newError(errCodeRequired, "piccData", "tag %s only accepts SUN reads, piccData and cmac fields are required", tag.TagUID)
+	}
+	err := validatePattern("piccData", entryLogInput.PICCData, piccDataPattern)
+	if err != nil {
+		return err
+	}
+	err = validatePattern("cmac", entryLogInput.CMAC, sunCMACPattern)
+	if err != nil {
+		return err
+	}
+
+	sun, err := readTagSUN(stub, tag.TagUID)
+	if err != nil {
+		return err
+	} else if sun == nil {
+		return newError(errCodeNotFound, "tagUID", "SUN keys of tag %s are not in this peer's collection", tag.TagUID)
+	}
+	metaReadKey, _ := hex.DecodeString(sun.SDMMetaReadKey)
+	fileReadKey, _ := hex.DecodeString(sun.SDMFileReadKey)
+	piccData, _ := hex.DecodeString(entryLogInput.PICCData)
+	mac, _ := hex.DecodeString(entryLogInput.CMAC)
+
+	uid, readCounter, err := decryptPICCData(metaReadKey, piccData)
+	if err != nil {
+		return err
+	}
+	if strings.ToUpper(hex.EncodeToString(uid)) != tag.TagUID {
+		return newError(errCodePermissionDenied, "piccData", "piccData was not read from tag %s", tag.TagUID)
+	}
+	expected, err := sunMAC(fileReadKey, uid, readCounter)
+	if err != nil {
+		return err
+	}
+	if subtle.ConstantTimeCompare(expected, mac) != 1 {
+		return newError(errCodePermissionDenied, "cmac", "cmac does not match the SUN message of tag %s", tag.TagUID)
+	}
+
+	lastCounter, ok := counters[tag.TagUID]
+	if !ok {
+		lastCounter = sun.ReadCounter
+	}
+	if readCounter <= lastCounter {
+		return newError(errCodeConflict, "piccData", "read counter %d of tag %s is not above %d, the SUN message was replayed", readCounter, tag.TagUID, lastCounter)
+	}
+
+	sun.ReadCounter = readCounter
+	entryLogInput.sun = sun
+	return nil
+}
+
+// ===========================================================================
+// decryptPICCData - the UID and SDMReadCtr of encrypted PICC data (AN12196 section 3.4.2)
+// ===========================================================================
+func decryptPICCData(metaReadKey []byte, piccData []byte) ([]byte, int, error) {
+	block, err := aes.NewCipher(metaReadKey)
+	if err != nil {
+		return nil, 0, err
+	}
+	plaintext := make([]byte, aes.BlockSize)
+	cipher.NewCBCDecrypter(block, make([]byte, aes.BlockSize)).CryptBlocks(plaintext, piccData)
+
+	if plaintext[0] != piccDataTagUIDAndCounter {
+		return nil, 0, newError(errCodePermissionDenied, "piccData", "piccData does not decrypt to a UID and read counter under the tag's key")
+	}
+	uid := plaintext[1:8]
+	// SDMReadCtr is 3 bytes, least significant first
+	readCounter := int(plaintext[8]) | int(plaintext[9])<<8 | int(plaintext[10])<<16
+	return uid, readCounter, nil
+}
+
+// ===========================================================================
+// sunMAC - the SDMMAC of a read without mirrored file data (AN12196 section 3.4.4):
+// the odd bytes of the CMAC, over nothing, under the session key
+// KSesSDMFileReadMAC = CMAC(SDMFileReadKey, 3CC3 0001 0080 || UID || SDMReadCtr)
+// ===========================================================================
+func sunMAC(fileReadKey []byte, uid []byte, readCounter int) ([]byte, error) {
+	sv2 := []byte{0x3c, 0xc3, 0x00, 0x01, 0x00, 0x80}
+	sv2 = append(sv2, uid...)
+	sv2 = append(sv2, byte(readCounter), byte(readCounter>>8), byte(readCounter>>16))
+
+	sessionKey, err := aesCMAC(fileReadKey, sv2)
+	if err != nil {
+		return nil, err
+	}
+	full, err := aesCMAC(sessionKey, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	truncated := make([]byte, 0, len(full)/2)
+	for i := 1; i < len(full); i += 2 {
+		truncated = append(truncated, full[i])
+	}
+	return truncated, nil
+}
+
+// ===========================================================================
+// aesCMAC - AES-CMAC of message under key (RFC 4493)
+// ===========================================================================
+func aesCMAC(key []byte, message []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// ==== Subkeys K1 and K2 ====
+	k1 := make([]byte, aes.BlockSize)
+	block.Encrypt(k1, k1)
+	k1 = shiftLeftOneBit(k1)
+	k2 := shiftLeftOneBit(k1)
+
+	// ==== Pad the last block, or XOR it with K1 when it is complete ====
+	blocks := (len(message) + aes.BlockSize - 1) / aes.BlockSize
+	last := make([]byte, aes.BlockSize)
+	if blocks == 0 || len(message)%aes.BlockSize != 0 {
+		if blocks == 0 {
+			blocks = 1
+		}
+		rest := message[(blocks-1)*aes.BlockSize:]
+		copy(last, rest)
+		last[len(rest)] = 0x80
+		xorBlock(last, k2)
+	} else {
+		copy(last, message[(blocks-1)*aes.BlockSize:])
+		xorBlock(last, k1)
+	}
+
+	mac := make([]byte, aes.BlockSize)
+	for i := 0; i < blocks-1; i++ {
+		xorBlock(mac, message[i*aes.BlockSize:(i+1)*aes.BlockSize])
+		block.Encrypt(mac, mac)
+	}
+	xorBlock(mac, last)
+	block.Encrypt(mac, mac)
+	return mac, nil
+}
+
+// xorBlock - dst ^= src for one AES block
+func xorBlock(dst []byte, src []byte) {
+	for i := 0; i < aes.BlockSize; i++ {
+		dst[i] ^= src[i]
+	}
+}
+
+// shiftLeftOneBit - the CMAC subkey doubling in GF(2^128)
+func shiftLeftOneBit(in []byte) []byte {
+	out := make([]byte, len(in))
+	for i := 0; i < len(in)-1; i++ {
+		out[i] = in[i]<<1 | in[i+1]>>7
+	}
+	out[len(in)-1] = in[len(in)-1] << 1
+	if in[0]&0x80 != 0 {
+		out[len(in)-1] ^= 0x87
+	}
+	return out
+}
+
+// ===========================================================================
+// readTagSUN - read and decode the SUN keys and counter of a tag, nil if it has none
+// ===========================================================================
+func readTagSUN(stub shim.ChaincodeStubInterface, tagUID string) (*tagSUN, error) {
+	sunKey, err := stub.CreateCompositeKey(tagSUNObjectType, []string{tagUID})
+	if err != nil {
+		return nil, err
+	}
+	sunAsBytes, err := stub.GetPrivateData("collectionTagKeys", sunKey)
+	if err != nil {
+		return nil, err
+	} else if sunAsBytes == nil {
+		return nil, nil
+	}
+
+	sun := &tagSUN{}
+	err = json.Unmarshal(sunAsBytes, sun)
+	if err != nil {
+		return nil, err
+	}
+	return sun, nil
+}
+
+// ===========================================================================
+// putTagSUN - save the SUN keys and counter of a tag
+// ===========================================================================
+func putTagSUN(stub shim.ChaincodeStubInterface, sun *tagSUN) error {
+	sunKey, err := stub.CreateCompositeKey(tagSUNObjectType, []string{sun.TagUID})
+	if err != nil {
+		return err
+	}
+
+	sunAsBytes, err := json.Marshal(sun)
+	if err != nil {
+		return err
+	}
+	return stub.PutPrivateData("collectionTagKeys", sunKey, sunAsBytes)
+}
@@ -0,0 +1,87 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func decodeHex(t *testing.T, s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatalf("bad hex %q: %s", s, err)
+	}
+	return b
+}
+
+// RFC 4493 section 4, AES-128 examples 1 to 4
+func TestAESCMAC(t *testing.T) {
+	key := "2b7e151628aed2a6abf7158809cf4f3c"
+	message := "6bc1bee22e409f96e93d7e117393172a" +
+		"ae2d8a571e03ac9c9eb76fac45af8e51" +
+		"30c81c46a35ce411e5fbc1191a0a52ef" +
+		"f69f2445df4f9b17ad2b417be66c3710"
+	tests := []struct {
+		length int
+		mac    string
+	}{
+		{0, "bb1d6929e95937287fa37d129b756746"},
+		{16, "070a16b46b4d4144f79bdd9dd04a287c"},
+		{40, "dfa66747de9ae63030ca32611497c827"},
+		{64, "51f0bebf7e3b9d92fc49741779363cfe"},
+	}
+
+	for _, test := range tests {
+		mac, err := aesCMAC(decodeHex(t, key), decodeHex(t, message)[:test.length])
+		if err != nil {
+			t.Fatalf("length %d: %s", test.length, err)
+		}
+		if hex.EncodeToString(mac) != test.mac {
+			t.Errorf("length %d: got %x, want %s", test.length, mac, test.mac)
+		}
+	}
+}
+
+// AN12196 example, PICC data encrypted under an all zero SDM meta read key
+func TestDecryptPICCData(t *testing.T) {
+	uid, readCounter, err := decryptPICCData(make([]byte, 16), decodeHex(t, "EF963FF7828658A599F3041510671E88"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ToUpper(hex.EncodeToString(uid)) != "04DE5F1EACC040" {
+		t.Errorf("got UID %X, want 04DE5F1EACC040", uid)
+	}
+	if readCounter != 0x3d {
+		t.Errorf("got read counter %d, want %d", readCounter, 0x3d)
+	}
+
+	_, _, err = decryptPICCData(decodeHex(t, strings.Repeat("11", 16)), decodeHex(t, "EF963FF7828658A599F3041510671E88"))
+	if err == nil {
+		t.Error("PICC data decrypted under the wrong key was accepted")
+	}
+}
+
+// AN12196 example, SDMMAC of a read without mirrored file data under an all zero SDM file read key
+func TestSunMAC(t *testing.T) {
+	mac, err := sunMAC(make([]byte, 16), decodeHex(t, "04DE5F1EACC040"), 0x3d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ToUpper(hex.EncodeToString(mac)) != "94EED9EE65337086" {
+		t.Errorf("got %X, want 94EED9EE65337086", mac)
+	}
+
+	mac, err = sunMAC(make([]byte, 16), decodeHex(t, "04DE5F1EACC040"), 0x3e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ToUpper(hex.EncodeToString(mac)) == "94EED9EE65337086" {
+		t.Error("the SDMMAC does not depend on the read counter")
+	}
+}
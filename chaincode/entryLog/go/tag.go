@@ -0,0 +1,386 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/lib/cid"
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// NFC tags are kept in world state next to the facility registry, under the composite
+// key nfcTag~<tagUID>, and listed per facility by the index facility~nfcTag~<facilityID>~<tagUID>.
+// A tag is bound to one entrance of one facility; a revoked tag stays registered so
+// its UID cannot be handed out again. Once a facility has an active tag its entries
+// must be read from a tag, see hasActiveTags.
+const (
+	tagObjectType    = "nfcTag"
+	tagIndexName     = "facility~nfcTag"
+	tagStatusActive  = "active"
+	tagStatusRevoked = "revoked"
+)
+
+const maxEntranceLength = 50
+
+// tagUIDPattern matches the 4, 7 or 10 byte UIDs of ISO 14443-A tags in upper case hex
+var tagUIDPattern = regexp.MustCompile(`^([0-9A-F]{8}|[0-9A-F]{14}|[0-9A-F]{20})$`)
+
+type nfcTag struct {
+	ObjectType          string `json:"docType"`
+	TagUID              string `json:"tagUID"`
+	FacilityID          string `json:"facilityID"`
+	Entrance            string `json:"entrance"` // main door, back door, ...
+	Status              string `json:"status"`   // active or revoked
+	SUN                 bool   `json:"sun"`      // entries must carry a verified SUN message, see verifyTagSUN
+	RegisteredTimestamp int64  `json:"registeredTimestamp"`
+	RevokedTimestamp    int64  `json:"revokedTimestamp,omitempty"`
+}
+
+// ===========================================================================
+// registerTag - bind an NFC tag to an entrance of a facility owned by the caller's org.
+// Args: tag JSON {tagUID, facilityID, entrance}
+// Transient: tagKeys (optional) {sdmMetaReadKey, sdmFileReadKey} of an NTAG 424 DNA tag,
+// entries from the tag then need its SUN message
+// ===========================================================================
+func (t *SimpleChaincode) registerTag(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start register tag")
+
+	type tagInput struct {
+		TagUID     string `json:"tagUID"`
+		FacilityID string `json:"facilityID"`
+		Entrance   string `json:"entrance"`
+	}
+
+	if len(args) != 1 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting the tag JSON")
+	}
+
+	var input tagInput
+	err := decodeStrict([]byte(args[0]), &input)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	input.TagUID = normalizeTagUID(input.TagUID)
+
+	validations := []error{
+		validatePattern("tagUID", input.TagUID, tagUIDPattern),
+		validatePattern("facilityID", input.FacilityID, facilityIDPattern),
+		validateText("entrance", input.Entrance, maxEntranceLength),
+	}
+	for _, err := range validations {
+		if err != nil {
+			return toErrorResponse(err)
+		}
+	}
+
+	err = assertFacilityOwner(stub, input.FacilityID)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	existing, err := readTag(stub, input.TagUID)
+	if err != nil {
+		return toErrorResponse(err)
+	} else if existing != nil {
+		return errorResponse(errCodeAlreadyExists, "tagUID", "This tag already exists: %s", input.TagUID)
+	}
+	sun, err := getTagKeys(stub, input.TagUID)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	newTag := &nfcTag{
+		ObjectType:          tagObjectType,
+		TagUID:              input.TagUID,
+		FacilityID:          input.FacilityID,
+		Entrance:            input.Entrance,
+		Status:              tagStatusActive,
+		SUN:                 sun != nil,
+		RegisteredTimestamp: txTime.Unix(),
+	}
+	tagAsBytes, err := putTag(stub, newTag)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	if sun != nil {
+		err = putTagSUN(stub, sun)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+	}
+
+	// ==== Index the tag by facility ====
+	indexKey, err := stub.CreateCompositeKey(tagIndexName, []string{newTag.FacilityID, newTag.TagUID})
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	err = stub.PutState(indexKey, []byte{0x00})
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	fmt.Println("- end register tag (success)")
+	return shim.Success(tagAsBytes)
+}
+
+// ===========================================================================
+// revokeTag - stop accepting entries from a tag, only the facility's org may do so.
+// Args: tagUID
+// ===========================================================================
+func (t *SimpleChaincode) revokeTag(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	fmt.Println("- start revoke tag")
+
+	if len(args) != 1 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting tagUID of the tag to revoke")
+	}
+
+	tagUID := normalizeTagUID(args[0])
+	err := validatePattern("tagUID", tagUID, tagUIDPattern)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	tagToRevoke, err := readTag(stub, tagUID)
+	if err != nil {
+		return toErrorResponse(err)
+	} else if tagToRevoke == nil {
+		return errorResponse(errCodeNotFound, "tagUID", "tag does not exist: %s", tagUID)
+	}
+	if tagToRevoke.Status == tagStatusRevoked {
+		return errorResponse(errCodeConflict, "tagUID", "tag is already revoked: %s", tagUID)
+	}
+
+	err = assertFacilityOwner(stub, tagToRevoke.FacilityID)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	txTime, err := getTxTime(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	tagToRevoke.Status = tagStatusRevoked
+	tagToRevoke.RevokedTimestamp = txTime.Unix()
+	tagAsBytes, err := putTag(stub, tagToRevoke)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	fmt.Println("- end revoke tag (success)")
+	return shim.Success(tagAsBytes)
+}
+
+// ===========================================================================
+// listTags - the tags registered for a facility, optionally only those with a status.
+// Args: facilityID, status (optional)
+// ===========================================================================
+func (t *SimpleChaincode) listTags(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) < 1 || len(args) > 2 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting facilityID and an optional status")
+	}
+	facilityID := args[0]
+	status := ""
+	if len(args) == 2 {
+		status = args[1]
+	}
+	if len(status) != 0 && status != tagStatusActive && status != tagStatusRevoked {
+		return errorResponse(errCodeOutOfRange, "status", "status must be %s or %s", tagStatusActive, tagStatusRevoked)
+	}
+
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(tagIndexName, []string{facilityID})
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	defer resultsIterator.Close()
+
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	for resultsIterator.HasNext() {
+		res, err := resultsIterator.Next()
+		if err != nil {
+			return toErrorResponse(err)
+		}
+
+		_, compositeKeyParts, err := stub.SplitCompositeKey(res.Key)
+		if err != nil {
+			return toErrorResponse(err)
+		}
+		registered, err := readTag(stub, compositeKeyParts[1])
+		if err != nil {
+			return toErrorResponse(err)
+		} else if registered == nil {
+			continue
+		}
+		if len(status) != 0 && registered.Status != status {
+			continue
+		}
+
+		tagAsBytes, err := json.Marshal(registered)
+		if err != nil {
+			return errorResponse(errCodeInternal, "", "%s", err.Error())
+		}
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.Write(tagAsBytes)
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	return shim.Success(buffer.Bytes())
+}
+
+// ===========================================================================
+// resolveTagFacility - fill in the facility of an entryLog read from a tag.
+// The tag must be registered and active; a facilityID sent along must be the tag's.
+// A SUN tag's message is verified, counters are the read counters accepted so far.
+// ===========================================================================
+func resolveTagFacility(stub shim.ChaincodeStubInterface, entryLogInput *entryLogTransientInput, counters map[string]int) error {
+	entryLogInput.TagUID = normalizeTagUID(entryLogInput.TagUID)
+	err := validatePattern("tagUID", entryLogInput.TagUID, tagUIDPattern)
+	if err != nil {
+		return err
+	}
+
+	registered, err := readTag(stub, entryLogInput.TagUID)
+	if err != nil {
+		return err
+	} else if registered == nil {
+		return newError(errCodeNotFound, "tagUID", "tag is not registered: %s", entryLogInput.TagUID)
+	}
+	if registered.Status != tagStatusActive {
+		return newError(errCodeConflict, "tagUID", "tag is %s: %s", registered.Status, entryLogInput.TagUID)
+	}
+	if len(entryLogInput.FacilityID) != 0 && entryLogInput.FacilityID != registered.FacilityID {
+		return newError(errCodeConflict, "facilityID", "tag %s is bound to facility %s", registered.TagUID, registered.FacilityID)
+	}
+
+	if registered.SUN {
+		err = verifyTagSUN(stub, registered, entryLogInput, counters)
+		if err != nil {
+			return err
+		}
+	} else if len(entryLogInput.PICCData) != 0 || len(entryLogInput.CMAC) != 0 {
+		return newError(errCodeInvalidArgument, "piccData", "tag %s was registered without SUN keys", registered.TagUID)
+	}
+
+	entryLogInput.FacilityID = registered.FacilityID
+	return nil
+}
+
+// ===========================================================================
+// hasActiveTags - whether a facility has an active tag. Entries to such a facility must be
+// read from a tag, a bare facilityID would skip the tag and its SUN check.
+// ===========================================================================
+func hasActiveTags(stub shim.ChaincodeStubInterface, facilityID string) (bool, error) {
+	resultsIterator, err := stub.GetStateByPartialCompositeKey(tagIndexName, []string{facilityID})
+	if err != nil {
+		return false, err
+	}
+	defer resultsIterator.Close()
+
+	for resultsIterator.HasNext() {
+		res, err := resultsIterator.Next()
+		if err != nil {
+			return false, err
+		}
+		_, compositeKeyParts, err := stub.SplitCompositeKey(res.Key)
+		if err != nil {
+			return false, err
+		}
+		registered, err := readTag(stub, compositeKeyParts[1])
+		if err != nil {
+			return false, err
+		}
+		if registered != nil && registered.Status == tagStatusActive {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ===========================================================================
+// assertFacilityOwner - the caller's org must own the registered facility
+// ===========================================================================
+func assertFacilityOwner(stub shim.ChaincodeStubInterface, facilityID string) error {
+	registered, err := readFacility(stub, facilityID)
+	if err != nil {
+		return err
+	} else if registered == nil {
+		return newError(errCodeNotFound, "facilityID", "facility is not registered: %s", facilityID)
+	}
+
+	callerOrg, err := cid.GetMSPID(stub)
+	if err != nil {
+		return newError(errCodePermissionDenied, "", "Failed to get the MSP ID of the caller: %s", err.Error())
+	}
+	if callerOrg != registered.OwnerOrg {
+		return newError(errCodePermissionDenied, "facilityID", "facility %s is owned by %s", registered.FacilityID, registered.OwnerOrg)
+	}
+	return nil
+}
+
+// normalizeTagUID - readers report UIDs in either case and often with colons between bytes
+func normalizeTagUID(tagUID string) string {
+	return strings.ToUpper(strings.Replace(tagUID, ":", "", -1))
+}
+
+// ===========================================================================
+// readTag - read and decode a tag, nil if it is not registered
+// ===========================================================================
+func readTag(stub shim.ChaincodeStubInterface, tagUID string) (*nfcTag, error) {
+	tagKey, err := stub.CreateCompositeKey(tagObjectType, []string{tagUID})
+	if err != nil {
+		return nil, err
+	}
+	tagAsBytes, err := stub.GetState(tagKey)
+	if err != nil {
+		return nil, err
+	} else if tagAsBytes == nil {
+		return nil, nil
+	}
+
+	registered := &nfcTag{}
+	err = json.Unmarshal(tagAsBytes, registered)
+	if err != nil {
+		return nil, err
+	}
+	return registered, nil
+}
+
+// ===========================================================================
+// putTag - save a tag to world state, return the stored JSON
+// ===========================================================================
+func putTag(stub shim.ChaincodeStubInterface, tag *nfcTag) ([]byte, error) {
+	tagKey, err := stub.CreateCompositeKey(tagObjectType, []string{tag.TagUID})
+	if err != nil {
+		return nil, err
+	}
+
+	tagAsBytes, err := json.Marshal(tag)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(tagKey, tagAsBytes)
+	if err != nil {
+		return nil, err
+	}
+	return tagAsBytes, nil
+}
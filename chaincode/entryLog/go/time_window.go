@@ -0,0 +1,235 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+// The time indexes list every entryLog in collectionEntryLog under
+// facility~time~entryLog~<facilityID>~<day>~<entryTimestamp>~<entryLogID> and
+// person~time~entryLog~<personalID>~<day>~<entryTimestamp>~<entryLogID>.
+// day is the UTC date of the entry, so a window only reads the days it spans, and
+// entryTimestamp is zero padded so the keys of a day sort chronologically.
+const (
+	facilityTimeIndex = "facility~time~entryLog"
+	personTimeIndex   = "person~time~entryLog"
+)
+
+const (
+	timeIndexDayLayout = "2006-01-02"
+	// maxTimeWindowDays bounds the days one window query reads
+	maxTimeWindowDays = 31
+)
+
+// timeIndexAttributes - the attributes of an entryLog's key in a time index of owner
+func timeIndexAttributes(owner string, entry *entryLog) []string {
+	day := time.Unix(entry.EntryTimestamp, 0).UTC().Format(timeIndexDayLayout)
+	return []string{owner, day, fmt.Sprintf("%012d", entry.EntryTimestamp), entry.EntryLogID}
+}
+
+// ===========================================================================
+// queryEntryLogsByFacilityTime - the entryLogs of a facility whose entryTime is in a window,
+// oldest first. Args: facilityID, start, end (entryTime format, inclusive)
+// ===========================================================================
+func (t *SimpleChaincode) queryEntryLogsByFacilityTime(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting facilityID, start and end")
+	}
+
+	err := validatePattern("facilityID", args[0], facilityIDPattern)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	err = assertFacilityQueryCaller(stub, args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	results, err := getEntryLogsByTimeWindow(stub, facilityTimeIndex, []string{args[0]}, args[1], args[2])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	return shim.Success(results)
+}
+
+// ===========================================================================
+// queryEntryLogsByPersonTime - the entryLogs of a person whose entryTime is in a window,
+// oldest first. Args: personalID, start, end (entryTime format, inclusive)
+// Transient: pseudonymKey, needed for a raw personalID
+// ===========================================================================
+func (t *SimpleChaincode) queryEntryLogsByPersonTime(stub shim.ChaincodeStubInterface, args []string) pb.Response {
+	if len(args) != 3 {
+		return errorResponse(errCodeInvalidArgument, "", "Incorrect number of arguments. Expecting personalID, start and end")
+	}
+
+	// a raw personalID needs the pseudonym key in the transient map
+	key, err := getPseudonymKey(stub)
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	err = assertPersonQueryCaller(stub, key, args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	personalIDs, err := personalIDAliases(key, "personalID", args[0])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+
+	results, err := getEntryLogsByTimeWindow(stub, personTimeIndex, personalIDs, args[1], args[2])
+	if err != nil {
+		return toErrorResponse(err)
+	}
+	return shim.Success(results)
+}
+
+// ===========================================================================
+// parseTimeWindow - the UTC epoch seconds of the start and end of a window
+// ===========================================================================
+func parseTimeWindow(config *chaincodeConfig, start string, end string) (int64, int64, error) {
+	startTime, err := parseEntryTime(config, start)
+	if err != nil {
+		return 0, 0, newError(errCodeInvalidFormat, "start", "start %s", err.Error())
+	}
+	endTime, err := parseEntryTime(config, end)
+	if err != nil {
+		return 0, 0, newError(errCodeInvalidFormat, "end", "end %s", err.Error())
+	}
+	if endTime.Before(startTime) {
+		return 0, 0, newError(errCodeOutOfRange, "end", "end must not be before start")
+	}
+	if endTime.Sub(startTime) > maxTimeWindowDays*24*time.Hour {
+		return 0, 0, newError(errCodeOutOfRange, "end", "a window spans at most %d days", maxTimeWindowDays)
+	}
+	return startTime.Unix(), endTime.Unix(), nil
+}
+
+// ===========================================================================
+// getEntryLogsByTimeWindow - the entryLogs listed under any of owners in a time index
+// whose entryTimestamp is in the window, as a JSON array ordered by entryTimestamp
+// ===========================================================================
+func getEntryLogsByTimeWindow(stub shim.ChaincodeStubInterface, indexName string, owners []string, start string, end string) ([]byte, error) {
+	config, err := getConfig(stub)
+	if err != nil {
+		return nil, err
+	}
+	startTimestamp, endTimestamp, err := parseTimeWindow(config, start, end)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := readTimeWindow(stub, config, indexName, owners, startTimestamp, endTimestamp)
+	if err != nil {
+		return nil, err
+	}
+
+	// buffer is a JSON array containing QueryRecords
+	var buffer bytes.Buffer
+	buffer.WriteString("[")
+
+	bArrayMemberAlreadyWritten := false
+	for _, entry := range entries {
+		entryLogJSONasBytes, err := json.Marshal(entry)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add a comma before array members, suppress it for the first array member
+		if bArrayMemberAlreadyWritten == true {
+			buffer.WriteString(",")
+		}
+		buffer.WriteString("{\"Key\":")
+		buffer.WriteString("\"")
+		buffer.WriteString(entry.EntryLogID)
+		buffer.WriteString("\"")
+
+		buffer.WriteString(", \"Record\":")
+		// Record is a JSON object, so we write as-is
+		buffer.WriteString(string(entryLogJSONasBytes))
+		buffer.WriteString("}")
+		bArrayMemberAlreadyWritten = true
+	}
+	buffer.WriteString("]")
+
+	return buffer.Bytes(), nil
+}
+
+// ===========================================================================
+// readTimeWindow - read the entryLogs listed under any of owners in a time index with an
+// entryTimestamp from startTimestamp to endTimestamp, ordered by entryTimestamp
+// ===========================================================================
+func readTimeWindow(stub shim.ChaincodeStubInterface, config *chaincodeConfig, indexName string, owners []string, startTimestamp int64, endTimestamp int64) ([]*entryLog, error) {
+	var entries []*entryLog
+	for _, owner := range owners {
+		for day := time.Unix(startTimestamp, 0).UTC().Truncate(24 * time.Hour); day.Unix() <= endTimestamp; day = day.AddDate(0, 0, 1) {
+			resultsIterator, err := stub.GetPrivateDataByPartialCompositeKey("collectionEntryLog", indexName, []string{owner, day.Format(timeIndexDayLayout)})
+			if err != nil {
+				return nil, err
+			}
+
+			for resultsIterator.HasNext() {
+				res, err := resultsIterator.Next()
+				if err != nil {
+					resultsIterator.Close()
+					return nil, err
+				}
+
+				_, compositeKeyParts, err := stub.SplitCompositeKey(res.Key)
+				if err != nil {
+					resultsIterator.Close()
+					return nil, err
+				}
+				entryTimestamp, err := strconv.ParseInt(compositeKeyParts[2], 10, 64)
+				if err != nil {
+					resultsIterator.Close()
+					return nil, err
+				}
+				if entryTimestamp < startTimestamp {
+					continue
+				}
+				if entryTimestamp > endTimestamp {
+					break
+				}
+
+				entryLogAsBytes, err := stub.GetPrivateData("collectionEntryLog", compositeKeyParts[3])
+				if err != nil {
+					resultsIterator.Close()
+					return nil, err
+				} else if entryLogAsBytes == nil {
+					// the index entry outlived its record
+					continue
+				}
+				// older records are returned in the current schema
+				entry, _, err := readEntryLog(config, entryLogAsBytes)
+				if err != nil {
+					resultsIterator.Close()
+					return nil, err
+				}
+				entries = append(entries, entry)
+			}
+			resultsIterator.Close()
+		}
+	}
+
+	// the entries of a raw personalID and its pseudonym are merged
+	sort.SliceStable(entries, func(i, j int) bool {
+		if entries[i].EntryTimestamp != entries[j].EntryTimestamp {
+			return entries[i].EntryTimestamp < entries[j].EntryTimestamp
+		}
+		return entries[i].EntryLogID < entries[j].EntryLogID
+	})
+	return entries, nil
+}
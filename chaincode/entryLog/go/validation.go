@@ -0,0 +1,169 @@
+/*
+Copyright IBM Corp. All Rights Reserved.
+
+SPDX-License-Identifier: Apache-2.0
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var (
+	// entryLogIDPattern also admits the ledger-assigned <txID>-<index> form
+	entryLogIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.:-]{0,127}$`)
+	facilityIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+	personalIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,63}$`)
+	yearPattern       = regexp.MustCompile(`^[0-9]{4}$`)
+	// Korean mobile (010, 011, 016-019), Seoul (02), regional (031-064) and VoIP (070)
+	// numbers, with or without hyphens
+	phonePattern = regexp.MustCompile(`^(01[016789]|02|0[3-6][1-5]|070)-?[0-9]{3,4}-?[0-9]{4}$`)
+	// pseudonymPattern matches the keyed pseudonyms stored in place of personalIDs
+	pseudonymPattern = regexp.MustCompile(`^pid-[0-9a-f]{64}$`)
+)
+
+// gender values, as sent by the reader apps
+var genders = map[string]bool{
+	"1": true, // male
+	"2": true, // female
+}
+
+const (
+	minBirthYear     = 1900
+	maxNameLength    = 50
+	maxAddressLength = 200
+)
+
+// ===========================================================================
+// decodeStrict - decode a transient JSON value, rejecting fields v does not declare
+// ===========================================================================
+func decodeStrict(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err == nil {
+		return nil
+	}
+
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		return newError(errCodeInvalidFormat, typeErr.Field, "%s field must be a JSON %s", typeErr.Field, typeErr.Type.String())
+	}
+	if strings.HasPrefix(err.Error(), "json: unknown field ") {
+		field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+		return newError(errCodeUnknownField, field, "%s is not a known field", field)
+	}
+	return newError(errCodeInvalidJSON, "", "Failed to decode JSON: %s", err.Error())
+}
+
+// ===========================================================================
+// validateRequired - the field must be a non-empty string
+// ===========================================================================
+func validateRequired(field string, value string) error {
+	if len(value) == 0 {
+		return newError(errCodeRequired, field, "%s field must be a non-empty string", field)
+	}
+	return nil
+}
+
+// ===========================================================================
+// validatePattern - the field must be non-empty and match pattern
+// ===========================================================================
+func validatePattern(field string, value string, pattern *regexp.Regexp) error {
+	err := validateRequired(field, value)
+	if err != nil {
+		return err
+	}
+	if !pattern.MatchString(value) {
+		return newError(errCodeInvalidFormat, field, "%s field must match %s", field, pattern.String())
+	}
+	return nil
+}
+
+// ===========================================================================
+// validatePersonalID - the field must be a raw personalID or a pseudonym
+// ===========================================================================
+func validatePersonalID(field string, value string) error {
+	if pseudonymPattern.MatchString(value) {
+		return nil
+	}
+	return validatePattern(field, value, personalIDPattern)
+}
+
+// ===========================================================================
+// validateText - the field must be non-empty, printable and at most maxLength characters
+// ===========================================================================
+func validateText(field string, value string, maxLength int) error {
+	err := validateRequired(field, value)
+	if err != nil {
+		return err
+	}
+	if !utf8.ValidString(value) || strings.IndexFunc(value, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0 {
+		return newError(errCodeInvalidFormat, field, "%s field must be printable UTF-8 text", field)
+	}
+	if utf8.RuneCountInString(value) > maxLength {
+		return newError(errCodeOutOfRange, field, "%s field must not be longer than %d characters", field, maxLength)
+	}
+	return nil
+}
+
+// ===========================================================================
+// validateGender - the field must be one of the known gender values
+// ===========================================================================
+func validateGender(value string) error {
+	err := validateRequired("gender", value)
+	if err != nil {
+		return err
+	}
+	if !genders[value] {
+		return newError(errCodeOutOfRange, "gender", "gender field must be 1 (male) or 2 (female)")
+	}
+	return nil
+}
+
+// ===========================================================================
+// validateYear - the birth year must be four digits between minBirthYear and currentYear
+// ===========================================================================
+func validateYear(value string, currentYear int) error {
+	err := validatePattern("year", value, yearPattern)
+	if err != nil {
+		return err
+	}
+	year, _ := strconv.Atoi(value)
+	if year < minBirthYear || year > currentYear {
+		return newError(errCodeOutOfRange, "year", "year field must be between %d and %d", minBirthYear, currentYear)
+	}
+	return nil
+}
+
+// ===========================================================================
+// validateEntryLogFields - apply the domain rules to every field of a new entryLog
+// ===========================================================================
+func validateEntryLogFields(entryLogInput *entryLogTransientInput, currentYear int) error {
+	if len(entryLogInput.EntryLogID) != 0 && !entryLogIDPattern.MatchString(entryLogInput.EntryLogID) {
+		return newError(errCodeInvalidFormat, "entryLogID", "entryLogID field must match %s", entryLogIDPattern.String())
+	}
+
+	validations := []error{
+		validatePattern("facilityID", entryLogInput.FacilityID, facilityIDPattern),
+		validateYear(entryLogInput.Year, currentYear),
+		validateGender(entryLogInput.Gender),
+		validateRequired("entryTime", entryLogInput.EntryTime),
+		validatePersonalID("personalID", entryLogInput.PersonalID),
+		validateText("name", entryLogInput.Name, maxNameLength),
+		validatePattern("phone", entryLogInput.Phone, phonePattern),
+		validateText("address", entryLogInput.Address, maxAddressLength),
+	}
+	for _, err := range validations {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}